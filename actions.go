@@ -1,6 +1,8 @@
 package scalc
 
 import (
+	"encoding"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math"
@@ -12,65 +14,172 @@ import (
 )
 
 // actions опередеяет набор операций, выполняемых калькулятором
-var actions = map[string]operators{
+var actions = map[string]Operation{
 	// Работа со стеком
-	"drop": func(do *does) { // Удаление значения из вершины стека
-		do.stack = do.stack[:len(do.stack)-1]
+	"drop": { // Удаление значения из вершины стека
+		func(do *does) {
+			do.need(1)
+			do.stack = do.stack[:len(do.stack)-1]
+		},
+		func(chk *checks) (err *Error) {
+			_, err = chk.pop(1)
+			return
+		},
+		1, true, "drop",
 	},
-	"dup": func(do *does) { // Дублирование вершины стека
-		do.stack = append(do.stack, do.stack[len(do.stack)-1])
+	"dup": { // Дублирование вершины стека
+		func(do *does) {
+			do.need(1)
+			do.stack = append(do.stack, do.stack[len(do.stack)-1])
+		},
+		func(chk *checks) *Error {
+			kinds, err := chk.pop(1)
+			if err == nil {
+				chk.push(kinds[0], kinds[0])
+			}
+			return err
+		},
+		1, true, "dup",
 	},
-	"swap": func(do *does) { // Обмен двух значений в врешине стека
-		last := len(do.stack) - 1
-		temp := do.stack[last]
-		do.stack[last] = do.stack[last-1]
-		do.stack[last-1] = temp
+	"swap": { // Обмен двух значений в врешине стека
+		func(do *does) {
+			do.need(2)
+			last := len(do.stack) - 1
+			temp := do.stack[last]
+			do.stack[last] = do.stack[last-1]
+			do.stack[last-1] = temp
+		},
+		func(chk *checks) *Error {
+			kinds, err := chk.pop(2)
+			if err == nil {
+				chk.push(kinds[1], kinds[0])
+			}
+			return err
+		},
+		2, true, "swap",
 	},
-	"over": func(do *does) { // Запись в стек второго от вершины значния
-		do.stack = append(do.stack, do.stack[len(do.stack)-2])
+	"over": { // Запись в стек второго от вершины значния
+		func(do *does) {
+			do.need(2)
+			do.stack = append(do.stack, do.stack[len(do.stack)-2])
+		},
+		func(chk *checks) *Error {
+			kinds, err := chk.pop(2)
+			if err == nil {
+				chk.push(kinds[0], kinds[1], kinds[0])
+			}
+			return err
+		},
+		2, true, "over",
 	},
 
 	// Работа с параметрами
-	"@": func(do *does) { // Запись в стек значения параметра с заданным именем
-		last := len(do.stack) - 1
-		do.stack[last] = getArgument(do.args[do.stack[last].(string)])
+	"@": { // Запись в стек значения параметра с заданным именем
+		func(do *does) {
+			do.need(1)
+			last := len(do.stack) - 1
+			name, ok := do.stack[last].(string)
+			if !ok {
+				panic(mismatch(kindOf(do.stack[last])))
+			}
+			value, exists := do.argument(name)
+			if !exists {
+				panic(failure(ErrNotFound, fmt.Errorf("parameter %#v is not found", name)))
+			}
+			do.stack[last] = getArgument(name, value)
+		},
+		func(chk *checks) *Error {
+			return chk.operands(1, Any, [][]reflect.Kind{{reflect.String}})
+		},
+		1, false, "@",
+	},
+	"?@": { // Проверка наличия параметра с заданным именем (параметр со значением nil считается отсутствующим)
+		func(do *does) {
+			do.need(1)
+			last := len(do.stack) - 1
+			name, ok := do.stack[last].(string)
+			if !ok {
+				panic(mismatch(kindOf(do.stack[last])))
+			}
+			value, exists := do.argument(name)
+			do.stack[last] = exists && !isNil(value)
+		},
+		func(chk *checks) *Error {
+			return chk.operands(1, reflect.Bool, [][]reflect.Kind{{reflect.String}})
+		},
+		1, false, "",
+	},
+	"@?": { // Запись в стек значения параметра с заданным именем или значения по умолчанию, если параметр отсутствует
+		func(do *does) {
+			do.need(2)
+			last := len(do.stack) - 1
+			name, ok := do.stack[last-1].(string)
+			if !ok {
+				panic(mismatch(kindOf(do.stack[last-1]), kindOf(do.stack[last])))
+			}
+			if value, exists := do.argument(name); exists && !isNil(value) {
+				do.stack[last-1] = getArgument(name, value)
+			} else {
+				do.stack[last-1] = do.stack[last]
+			}
+			do.stack = do.stack[:last]
+		},
+		func(chk *checks) *Error {
+			return chk.operands(2, Any, [][]reflect.Kind{{reflect.String, Any}})
+		},
+		2, false, "",
 	},
 
 	// Преобразование типов
-	"int": operatorUnary(unaryActions{ // Преобразование значения в целое число
+	"int": operatorUnary(reflect.Int64, UnaryActions{ // Преобразование значения в целое число
 		reflect.Int64:   func(val interface{}) interface{} { return val },
 		reflect.Float64: func(val interface{}) interface{} { return int64(val.(float64)) },
+		reflect.Bool:    func(val interface{}) interface{} { return convertBool(val.(bool)) },
 		reflect.String: func(val interface{}) interface{} {
 			if result, err := strconv.ParseInt(val.(string), 10, 64); err != nil {
-				panic(err)
+				panic(failure(ErrConversion, err))
 			} else {
 				return result
 			}
 		},
 	}),
-	"float": operatorUnary(unaryActions{ // Преобразование значения в вещественное число
+	"float": operatorUnary(reflect.Float64, UnaryActions{ // Преобразование значения в вещественное число
 		reflect.Int64:   func(val interface{}) interface{} { return float64(val.(int64)) },
 		reflect.Float64: func(val interface{}) interface{} { return val },
+		reflect.Bool:    func(val interface{}) interface{} { return float64(convertBool(val.(bool))) },
 		reflect.String: func(val interface{}) interface{} {
 			if result, err := strconv.ParseFloat(strings.ReplaceAll(val.(string), ",", "."), 64); err != nil {
-				panic(err)
+				panic(failure(ErrConversion, err))
 			} else {
 				return result
 			}
 		},
 	}),
-	"string": operatorUnary(unaryActions{ // Преобразование значения в строку
+	"string": operatorUnary(reflect.String, UnaryActions{ // Преобразование значения в строку
 		reflect.Int64:   func(val interface{}) interface{} { return strconv.FormatInt(val.(int64), 10) },
 		reflect.Float64: func(val interface{}) interface{} { return strconv.FormatFloat(val.(float64), 'g', -1, 64) },
 		reflect.String:  func(val interface{}) interface{} { return val },
+		reflect.Bool:    func(val interface{}) interface{} { return strconv.FormatBool(val.(bool)) },
+	}),
+	"bool": operatorUnary(reflect.Bool, UnaryActions{ // Преобразование значения в логическое
+		reflect.Int64:   func(val interface{}) interface{} { return val.(int64) != 0 },
+		reflect.Float64: func(val interface{}) interface{} { return val.(float64) != 0.0 },
+		reflect.String: func(val interface{}) interface{} {
+			if result, err := strconv.ParseBool(val.(string)); err != nil {
+				panic(failure(ErrConversion, err))
+			} else {
+				return result
+			}
+		},
+		reflect.Bool: func(val interface{}) interface{} { return val },
 	}),
 
 	// Унарные операции: число -> число
-	"--": operatorUnary(unaryActions{ // Инверсия знака числа
+	"--": operatorUnary(Same, UnaryActions{ // Инверсия знака числа
 		reflect.Int64:   func(val interface{}) interface{} { return -val.(int64) },
 		reflect.Float64: func(val interface{}) interface{} { return -val.(float64) },
 	}),
-	"abs": operatorUnary(unaryActions{ // Модуль числа
+	"abs": operatorUnary(Same, UnaryActions{ // Модуль числа
 		reflect.Int64: func(val interface{}) interface{} {
 			if temp := val.(int64); temp < 0 {
 				return -temp
@@ -81,7 +190,7 @@ var actions = map[string]operators{
 	}),
 
 	// Унарные операции: число -> целое
-	"sign": operatorUnary(unaryActions{ // Знак числа
+	"sign": operatorUnary(reflect.Int64, UnaryActions{ // Знак числа
 		reflect.Int64: func(val interface{}) interface{} {
 			if temp := val.(int64); temp < 0 {
 				return int64(-1)
@@ -99,109 +208,114 @@ var actions = map[string]operators{
 	}),
 
 	// Унарные операции: целое -> целое
-	"~": operatorUnary(unaryActions{ // Инверсия битов целого числа
+	"~": operatorUnary(reflect.Int64, UnaryActions{ // Инверсия битов целого числа
 		reflect.Int64: func(val interface{}) interface{} { return ^val.(int64) },
 	}),
-	"!": operatorUnary(unaryActions{ // Логическое NOT
-		reflect.Int64: func(val interface{}) interface{} {
-			return convertBool(val == int64(0))
-		},
+
+	// Унарные операции: целое / логическое -> логическое
+	"!": operatorUnary(reflect.Bool, UnaryActions{ // Логическое NOT
+		reflect.Int64: func(val interface{}) interface{} { return val == int64(0) },
+		reflect.Bool:  func(val interface{}) interface{} { return !val.(bool) },
+	}),
+	"not": operatorUnary(reflect.Bool, UnaryActions{ // Логическое NOT
+		reflect.Bool: func(val interface{}) interface{} { return !val.(bool) },
 	}),
 
 	// Унарные операции: вещественное -> вещественное
-	"sqrt": operatorUnary(unaryActions{ // Квадратный корень
+	"sqrt": operatorUnary(reflect.Float64, UnaryActions{ // Квадратный корень
 		reflect.Float64: func(val interface{}) interface{} { return math.Sqrt(val.(float64)) },
 	}),
-	"ln": operatorUnary(unaryActions{ // Квадратный корень
+	"ln": operatorUnary(reflect.Float64, UnaryActions{ // Квадратный корень
 		reflect.Float64: func(val interface{}) interface{} { return math.Log(val.(float64)) },
 	}),
-	"exp": operatorUnary(unaryActions{ // Квадратный корень
+	"exp": operatorUnary(reflect.Float64, UnaryActions{ // Квадратный корень
 		reflect.Float64: func(val interface{}) interface{} { return math.Exp(val.(float64)) },
 	}),
-	"floor": operatorUnary(unaryActions{ // Округление вниз
+	"floor": operatorUnary(reflect.Float64, UnaryActions{ // Округление вниз
 		reflect.Float64: func(val interface{}) interface{} { return math.Floor(val.(float64)) },
 	}),
-	"ceil": operatorUnary(unaryActions{ // Округление вверх
+	"ceil": operatorUnary(reflect.Float64, UnaryActions{ // Округление вверх
 		reflect.Float64: func(val interface{}) interface{} { return math.Ceil(val.(float64)) },
 	}),
-	"round": operatorUnary(unaryActions{ // Округление к ближайшёму
+	"round": operatorUnary(reflect.Float64, UnaryActions{ // Округление к ближайшёму
 		reflect.Float64: func(val interface{}) interface{} { return math.Round(val.(float64)) },
 	}),
-	"trunc": operatorUnary(unaryActions{ // Округление к ближайшёму
+	"trunc": operatorUnary(reflect.Float64, UnaryActions{ // Округление к ближайшёму
 		reflect.Float64: func(val interface{}) interface{} { return math.Trunc(val.(float64)) },
 	}),
-	"frac": operatorUnary(unaryActions{ // Округление к ближайшёму
+	"frac": operatorUnary(reflect.Float64, UnaryActions{ // Округление к ближайшёму
 		reflect.Float64: func(val interface{}) (res interface{}) {
 			_, res = math.Modf(val.(float64))
 			return
 		},
 	}),
 
-	// Унарные операции: вещественное -> целое
-	"isNaN": operatorUnary(unaryActions{ // Проверка на NaN
-		reflect.Float64: func(val interface{}) interface{} { return convertBool(math.IsNaN(val.(float64))) },
+	// Унарные операции: вещественное -> логическое
+	"isNaN": operatorUnary(reflect.Bool, UnaryActions{ // Проверка на NaN
+		reflect.Float64: func(val interface{}) interface{} { return math.IsNaN(val.(float64)) },
 	}),
-	"isInf": operatorUnary(unaryActions{ // Проверка на Inf
-		reflect.Float64: func(val interface{}) interface{} { return convertBool(math.IsInf(val.(float64), 0)) },
+	"isInf": operatorUnary(reflect.Bool, UnaryActions{ // Проверка на Inf
+		reflect.Float64: func(val interface{}) interface{} { return math.IsInf(val.(float64), 0) },
 	}),
 
 	// Унарные операции: строка -> строка
-	"trim": operatorUnary(unaryActions{ // Удаление краних пробельных символов
+	"trim": operatorUnary(reflect.String, UnaryActions{ // Удаление краних пробельных символов
 		reflect.String: func(val interface{}) interface{} { return strings.TrimSpace(val.(string)) },
 	}),
-	"upper": operatorUnary(unaryActions{ // Преобразование в верхний регистр
+	"upper": operatorUnary(reflect.String, UnaryActions{ // Преобразование в верхний регистр
 		reflect.String: func(val interface{}) interface{} { return strings.ToUpper(val.(string)) },
 	}),
-	"lower": operatorUnary(unaryActions{ // Преобразование в нижний регистр
+	"lower": operatorUnary(reflect.String, UnaryActions{ // Преобразование в нижний регистр
 		reflect.String: func(val interface{}) interface{} { return strings.ToLower(val.(string)) },
 	}),
 
 	// Унарные операции: строка -> целое
-	"len": operatorUnary(unaryActions{ // Длина строки
+	"len": operatorUnary(reflect.Int64, UnaryActions{ // Длина строки
 		reflect.String: func(val interface{}) interface{} { return int64(len(val.(string))) },
 	}),
 
-	// Унарные операции: знечение -> целое
-	"isEmpty": operatorUnary(unaryActions{ // Проверка на пустое значение
-		reflect.Int64:   func(val interface{}) interface{} { return convertBool(val.(int64) == 0) },
-		reflect.Float64: func(val interface{}) interface{} { return convertBool(val.(float64) == 0.0) },
-		reflect.String:  func(val interface{}) interface{} { return convertBool(val.(string) == "") },
+	// Унарные операции: знечение -> логическое
+	"isEmpty": operatorUnary(reflect.Bool, UnaryActions{ // Проверка на пустое значение
+		reflect.Int64:   func(val interface{}) interface{} { return val.(int64) == 0 },
+		reflect.Float64: func(val interface{}) interface{} { return val.(float64) == 0.0 },
+		reflect.String:  func(val interface{}) interface{} { return val.(string) == "" },
+		reflect.Bool:    func(val interface{}) interface{} { return !val.(bool) },
 	}),
 
 	// Бинарные операции: значение, значение -> значение
-	"+": operatorBinary(binaryActions{ // Сложение чисел / конкатенация строк
-		two{reflect.Int64, reflect.Int64}:     func(v1, v2 interface{}) interface{} { return v1.(int64) + v2.(int64) },
-		two{reflect.Float64, reflect.Float64}: func(v1, v2 interface{}) interface{} { return v1.(float64) + v2.(float64) },
-		two{reflect.String, reflect.String}:   func(v1, v2 interface{}) interface{} { return v1.(string) + v2.(string) },
+	"+": operatorBinary(Same, BinaryActions{ // Сложение чисел / конкатенация строк
+		Two{reflect.Int64, reflect.Int64}:     func(v1, v2 interface{}) interface{} { return v1.(int64) + v2.(int64) },
+		Two{reflect.Float64, reflect.Float64}: func(v1, v2 interface{}) interface{} { return v1.(float64) + v2.(float64) },
+		Two{reflect.String, reflect.String}:   func(v1, v2 interface{}) interface{} { return v1.(string) + v2.(string) },
 	}),
-	"min": operatorBinary(binaryActions{ // Не равно
-		two{reflect.Int64, reflect.Int64}: func(v1, v2 interface{}) interface{} {
+	"min": operatorBinary(Same, BinaryActions{ // Не равно
+		Two{reflect.Int64, reflect.Int64}: func(v1, v2 interface{}) interface{} {
 			if v1.(int64) < v2.(int64) {
 				return v1
 			}
 			return v2
 		},
-		two{reflect.Float64, reflect.Float64}: func(v1, v2 interface{}) interface{} {
+		Two{reflect.Float64, reflect.Float64}: func(v1, v2 interface{}) interface{} {
 			return math.Min(v1.(float64), v2.(float64))
 		},
-		two{reflect.String, reflect.String}: func(v1, v2 interface{}) interface{} {
+		Two{reflect.String, reflect.String}: func(v1, v2 interface{}) interface{} {
 			if v1.(string) < v2.(string) {
 				return v1
 			}
 			return v2
 		},
 	}),
-	"max": operatorBinary(binaryActions{ // Не равно
-		two{reflect.Int64, reflect.Int64}: func(v1, v2 interface{}) interface{} {
+	"max": operatorBinary(Same, BinaryActions{ // Не равно
+		Two{reflect.Int64, reflect.Int64}: func(v1, v2 interface{}) interface{} {
 			if v1.(int64) > v2.(int64) {
 				return v1
 			}
 			return v2
 		},
-		two{reflect.Float64, reflect.Float64}: func(v1, v2 interface{}) interface{} {
+		Two{reflect.Float64, reflect.Float64}: func(v1, v2 interface{}) interface{} {
 			return math.Max(v1.(float64), v2.(float64))
 		},
-		two{reflect.String, reflect.String}: func(v1, v2 interface{}) interface{} {
+		Two{reflect.String, reflect.String}: func(v1, v2 interface{}) interface{} {
 			if v1.(string) > v2.(string) {
 				return v1
 			}
@@ -210,188 +324,220 @@ var actions = map[string]operators{
 	}),
 
 	// Бинарные операции: число, число -> число
-	"-": operatorBinary(binaryActions{ // Вычитание
-		two{reflect.Int64, reflect.Int64}:     func(v1, v2 interface{}) interface{} { return v1.(int64) - v2.(int64) },
-		two{reflect.Float64, reflect.Float64}: func(v1, v2 interface{}) interface{} { return v1.(float64) - v2.(float64) },
-	}),
-	"*": operatorBinary(binaryActions{ // Умножение
-		two{reflect.Int64, reflect.Int64}:     func(v1, v2 interface{}) interface{} { return v1.(int64) * v2.(int64) },
-		two{reflect.Float64, reflect.Float64}: func(v1, v2 interface{}) interface{} { return v1.(float64) * v2.(float64) },
-	}),
-	"/": operatorBinary(binaryActions{ // Деление
-		two{reflect.Int64, reflect.Int64}:     func(v1, v2 interface{}) interface{} { return v1.(int64) / v2.(int64) },
-		two{reflect.Float64, reflect.Float64}: func(v1, v2 interface{}) interface{} { return v1.(float64) / v2.(float64) },
+	"-": operatorBinary(Same, BinaryActions{ // Вычитание
+		Two{reflect.Int64, reflect.Int64}:     func(v1, v2 interface{}) interface{} { return v1.(int64) - v2.(int64) },
+		Two{reflect.Float64, reflect.Float64}: func(v1, v2 interface{}) interface{} { return v1.(float64) - v2.(float64) },
+	}),
+	"*": operatorBinary(Same, BinaryActions{ // Умножение
+		Two{reflect.Int64, reflect.Int64}:     func(v1, v2 interface{}) interface{} { return v1.(int64) * v2.(int64) },
+		Two{reflect.Float64, reflect.Float64}: func(v1, v2 interface{}) interface{} { return v1.(float64) * v2.(float64) },
+	}),
+	"/": operatorBinary(Same, BinaryActions{ // Деление
+		Two{reflect.Int64, reflect.Int64}: func(v1, v2 interface{}) interface{} {
+			if v2.(int64) == 0 {
+				panic(failure(ErrDivisionByZero, errors.New("integer divide by zero")))
+			}
+			return v1.(int64) / v2.(int64)
+		},
+		Two{reflect.Float64, reflect.Float64}: func(v1, v2 interface{}) interface{} { return v1.(float64) / v2.(float64) },
 	}),
 
 	// Бинарные операции: вещественное, вещественное -> вещественное
-	"**": operatorBinary(binaryActions{ // Возведение в степень
-		two{reflect.Float64, reflect.Float64}: func(v1, v2 interface{}) interface{} { return math.Pow(v1.(float64), v2.(float64)) },
+	"**": operatorBinary(reflect.Float64, BinaryActions{ // Возведение в степень
+		Two{reflect.Float64, reflect.Float64}: func(v1, v2 interface{}) interface{} { return math.Pow(v1.(float64), v2.(float64)) },
 	}),
 
 	// Бинарные операции: целое, целое -> целое
-	"%": operatorBinary(binaryActions{ // Остаток от деления целых чисел
-		two{reflect.Int64, reflect.Int64}: func(v1, v2 interface{}) interface{} { return v1.(int64) % v2.(int64) },
+	"%": operatorBinary(reflect.Int64, BinaryActions{ // Остаток от деления целых чисел
+		Two{reflect.Int64, reflect.Int64}: func(v1, v2 interface{}) interface{} {
+			if v2.(int64) == 0 {
+				panic(failure(ErrDivisionByZero, errors.New("integer divide by zero")))
+			}
+			return v1.(int64) % v2.(int64)
+		},
 	}),
-	"&": operatorBinary(binaryActions{ // Битовое AND целых чисел
-		two{reflect.Int64, reflect.Int64}: func(v1, v2 interface{}) interface{} { return v1.(int64) & v2.(int64) },
+	"&": operatorBinary(reflect.Int64, BinaryActions{ // Битовое AND целых чисел
+		Two{reflect.Int64, reflect.Int64}: func(v1, v2 interface{}) interface{} { return v1.(int64) & v2.(int64) },
 	}),
-	"|": operatorBinary(binaryActions{ // Битовое OR целых чисел
-		two{reflect.Int64, reflect.Int64}: func(v1, v2 interface{}) interface{} { return v1.(int64) | v2.(int64) },
+	"|": operatorBinary(reflect.Int64, BinaryActions{ // Битовое OR целых чисел
+		Two{reflect.Int64, reflect.Int64}: func(v1, v2 interface{}) interface{} { return v1.(int64) | v2.(int64) },
 	}),
-	"^": operatorBinary(binaryActions{ // Битовое XOR целых чисел
-		two{reflect.Int64, reflect.Int64}: func(v1, v2 interface{}) interface{} { return v1.(int64) ^ v2.(int64) },
+	"^": operatorBinary(reflect.Int64, BinaryActions{ // Битовое XOR целых чисел
+		Two{reflect.Int64, reflect.Int64}: func(v1, v2 interface{}) interface{} { return v1.(int64) ^ v2.(int64) },
+	}),
+	"<<": operatorBinary(reflect.Int64, BinaryActions{ // Битовый сдвиг влево целого числа
+		Two{reflect.Int64, reflect.Int64}: func(v1, v2 interface{}) interface{} { return v1.(int64) << uint64(v2.(int64)) },
+	}),
+	">>": operatorBinary(reflect.Int64, BinaryActions{ // Битовый сдвиг враво целого числа
+		Two{reflect.Int64, reflect.Int64}: func(v1, v2 interface{}) interface{} { return v1.(int64) >> uint64(v2.(int64)) },
+	}),
+
+	// Бинарные операции: логическое, логическое -> логическое
+	"and": operatorBinary(reflect.Bool, BinaryActions{ // Логическое AND
+		Two{reflect.Bool, reflect.Bool}: func(v1, v2 interface{}) interface{} { return v1.(bool) && v2.(bool) },
 	}),
-	"<<": operatorBinary(binaryActions{ // Битовый сдвиг влево целого числа
-		two{reflect.Int64, reflect.Int64}: func(v1, v2 interface{}) interface{} { return v1.(int64) << uint64(v2.(int64)) },
+	"or": operatorBinary(reflect.Bool, BinaryActions{ // Логическое OR
+		Two{reflect.Bool, reflect.Bool}: func(v1, v2 interface{}) interface{} { return v1.(bool) || v2.(bool) },
 	}),
-	">>": operatorBinary(binaryActions{ // Битовый сдвиг враво целого числа
-		two{reflect.Int64, reflect.Int64}: func(v1, v2 interface{}) interface{} { return v1.(int64) >> uint64(v2.(int64)) },
+	"xor": operatorBinary(reflect.Bool, BinaryActions{ // Логическое XOR
+		Two{reflect.Bool, reflect.Bool}: func(v1, v2 interface{}) interface{} { return v1.(bool) != v2.(bool) },
 	}),
 
-	// Бинарные операции: значение, значение -> целое
-	"=": operatorBinary(binaryActions{ // Равно
-		two{reflect.Int64, reflect.Int64}: func(v1, v2 interface{}) interface{} {
-			return convertBool(v1.(int64) == v2.(int64))
+	// Бинарные операции: значение, значение -> логическое
+	"=": operatorBinary(reflect.Bool, BinaryActions{ // Равно
+		Two{reflect.Int64, reflect.Int64}: func(v1, v2 interface{}) interface{} {
+			return v1.(int64) == v2.(int64)
 		},
-		two{reflect.Float64, reflect.Float64}: func(v1, v2 interface{}) interface{} {
-			return convertBool(v1.(float64) == v2.(float64))
+		Two{reflect.Float64, reflect.Float64}: func(v1, v2 interface{}) interface{} {
+			return v1.(float64) == v2.(float64)
 		},
-		two{reflect.String, reflect.String}: func(v1, v2 interface{}) interface{} {
-			return convertBool(v1.(string) == v2.(string))
+		Two{reflect.String, reflect.String}: func(v1, v2 interface{}) interface{} {
+			return v1.(string) == v2.(string)
+		},
+		Two{reflect.Bool, reflect.Bool}: func(v1, v2 interface{}) interface{} {
+			return v1.(bool) == v2.(bool)
 		},
 	}),
-	"#": operatorBinary(binaryActions{ // Не равно
-		two{reflect.Int64, reflect.Int64}: func(v1, v2 interface{}) interface{} {
-			return convertBool(v1.(int64) != v2.(int64))
+	"#": operatorBinary(reflect.Bool, BinaryActions{ // Не равно
+		Two{reflect.Int64, reflect.Int64}: func(v1, v2 interface{}) interface{} {
+			return v1.(int64) != v2.(int64)
+		},
+		Two{reflect.Float64, reflect.Float64}: func(v1, v2 interface{}) interface{} {
+			return v1.(float64) != v2.(float64)
 		},
-		two{reflect.Float64, reflect.Float64}: func(v1, v2 interface{}) interface{} {
-			return convertBool(v1.(float64) != v2.(float64))
+		Two{reflect.String, reflect.String}: func(v1, v2 interface{}) interface{} {
+			return v1.(string) != v2.(string)
 		},
-		two{reflect.String, reflect.String}: func(v1, v2 interface{}) interface{} {
-			return convertBool(v1.(string) != v2.(string))
+		Two{reflect.Bool, reflect.Bool}: func(v1, v2 interface{}) interface{} {
+			return v1.(bool) != v2.(bool)
 		},
 	}),
-	">": operatorBinary(binaryActions{ // Больше
-		two{reflect.Int64, reflect.Int64}: func(v1, v2 interface{}) interface{} {
-			return convertBool(v1.(int64) > v2.(int64))
+	">": operatorBinary(reflect.Bool, BinaryActions{ // Больше
+		Two{reflect.Int64, reflect.Int64}: func(v1, v2 interface{}) interface{} {
+			return v1.(int64) > v2.(int64)
 		},
-		two{reflect.Float64, reflect.Float64}: func(v1, v2 interface{}) interface{} {
-			return convertBool(v1.(float64) > v2.(float64))
+		Two{reflect.Float64, reflect.Float64}: func(v1, v2 interface{}) interface{} {
+			return v1.(float64) > v2.(float64)
 		},
-		two{reflect.String, reflect.String}: func(v1, v2 interface{}) interface{} {
-			return convertBool(v1.(string) > v2.(string))
+		Two{reflect.String, reflect.String}: func(v1, v2 interface{}) interface{} {
+			return v1.(string) > v2.(string)
 		},
 	}),
-	"<": operatorBinary(binaryActions{ // Меньше
-		two{reflect.Int64, reflect.Int64}: func(v1, v2 interface{}) interface{} {
-			return convertBool(v1.(int64) < v2.(int64))
+	"<": operatorBinary(reflect.Bool, BinaryActions{ // Меньше
+		Two{reflect.Int64, reflect.Int64}: func(v1, v2 interface{}) interface{} {
+			return v1.(int64) < v2.(int64)
 		},
-		two{reflect.Float64, reflect.Float64}: func(v1, v2 interface{}) interface{} {
-			return convertBool(v1.(float64) < v2.(float64))
+		Two{reflect.Float64, reflect.Float64}: func(v1, v2 interface{}) interface{} {
+			return v1.(float64) < v2.(float64)
 		},
-		two{reflect.String, reflect.String}: func(v1, v2 interface{}) interface{} {
-			return convertBool(v1.(string) < v2.(string))
+		Two{reflect.String, reflect.String}: func(v1, v2 interface{}) interface{} {
+			return v1.(string) < v2.(string)
 		},
 	}),
-	">=": operatorBinary(binaryActions{ // Больше или равно
-		two{reflect.Int64, reflect.Int64}: func(v1, v2 interface{}) interface{} {
-			return convertBool(v1.(int64) >= v2.(int64))
+	">=": operatorBinary(reflect.Bool, BinaryActions{ // Больше или равно
+		Two{reflect.Int64, reflect.Int64}: func(v1, v2 interface{}) interface{} {
+			return v1.(int64) >= v2.(int64)
 		},
-		two{reflect.Float64, reflect.Float64}: func(v1, v2 interface{}) interface{} {
-			return convertBool(v1.(float64) >= v2.(float64))
+		Two{reflect.Float64, reflect.Float64}: func(v1, v2 interface{}) interface{} {
+			return v1.(float64) >= v2.(float64)
 		},
-		two{reflect.String, reflect.String}: func(v1, v2 interface{}) interface{} {
-			return convertBool(v1.(string) >= v2.(string))
+		Two{reflect.String, reflect.String}: func(v1, v2 interface{}) interface{} {
+			return v1.(string) >= v2.(string)
 		},
 	}),
-	"<=": operatorBinary(binaryActions{ // Меньше или равно
-		two{reflect.Int64, reflect.Int64}: func(v1, v2 interface{}) interface{} {
-			return convertBool(v1.(int64) <= v2.(int64))
+	"<=": operatorBinary(reflect.Bool, BinaryActions{ // Меньше или равно
+		Two{reflect.Int64, reflect.Int64}: func(v1, v2 interface{}) interface{} {
+			return v1.(int64) <= v2.(int64)
 		},
-		two{reflect.Float64, reflect.Float64}: func(v1, v2 interface{}) interface{} {
-			return convertBool(v1.(float64) <= v2.(float64))
+		Two{reflect.Float64, reflect.Float64}: func(v1, v2 interface{}) interface{} {
+			return v1.(float64) <= v2.(float64)
 		},
-		two{reflect.String, reflect.String}: func(v1, v2 interface{}) interface{} {
-			return convertBool(v1.(string) <= v2.(string))
+		Two{reflect.String, reflect.String}: func(v1, v2 interface{}) interface{} {
+			return v1.(string) <= v2.(string)
 		},
 	}),
 
 	// Бинарные операции: строка, строка -> целое
-	"index": operatorBinary(binaryActions{ // Поиск позиции первого вхождения подстроки
-		two{reflect.String, reflect.String}: func(v1, v2 interface{}) interface{} {
+	"index": operatorBinary(reflect.Int64, BinaryActions{ // Поиск позиции первого вхождения подстроки
+		Two{reflect.String, reflect.String}: func(v1, v2 interface{}) interface{} {
 			return int64(strings.Index(v1.(string), v2.(string)))
 		},
 	}),
-	"indexLast": operatorBinary(binaryActions{ // Поиск позиции последнего вхождения подстроки
-		two{reflect.String, reflect.String}: func(v1, v2 interface{}) interface{} {
+	"indexLast": operatorBinary(reflect.Int64, BinaryActions{ // Поиск позиции последнего вхождения подстроки
+		Two{reflect.String, reflect.String}: func(v1, v2 interface{}) interface{} {
 			return int64(strings.LastIndex(v1.(string), v2.(string)))
 		},
 	}),
-	"timeParse": operatorBinary(binaryActions{ // Преобразование записи даты/времени в числовую метку времени
-		two{reflect.String, reflect.String}: func(v1, v2 interface{}) interface{} {
+	"timeParse": operatorBinary(reflect.Int64, BinaryActions{ // Преобразование записи даты/времени в числовую метку времени
+		Two{reflect.String, reflect.String}: func(v1, v2 interface{}) interface{} {
 			if tm, err := time.Parse(v1.(string), v2.(string)); err != nil {
-				panic(err)
+				panic(failure(ErrConversion, err))
 			} else {
 				return tm.Unix()
 			}
 		},
 	}),
-	"regexMatch": operatorBinary(binaryActions{ // Проверка на соотвествие шаблону
-		two{reflect.String, reflect.String}: func(v1, v2 interface{}) interface{} {
+
+	// Бинарные операции: строка, строка -> логическое
+	"regexMatch": operatorLimited(guardRegex(1), operatorBinary(reflect.Bool, BinaryActions{ // Проверка на соотвествие шаблону
+		Two{reflect.String, reflect.String}: func(v1, v2 interface{}) interface{} {
 			if result, err := regexp.MatchString(v1.(string), v2.(string)); err != nil {
-				panic(err)
+				panic(failure(ErrOperand, err))
 			} else {
-				return convertBool(result)
+				return result
 			}
 		},
-	}),
+	})),
 
 	// Бинарные операции: строка, целое -> строка
-	"left": operatorBinary(binaryActions{ // Левая часть строки
-		two{reflect.String, reflect.Int64}: func(v1, v2 interface{}) interface{} {
-			return v1.(string)[:v2.(int64)]
+	"left": operatorBinary(reflect.String, BinaryActions{ // Левая часть строки
+		Two{reflect.String, reflect.Int64}: func(v1, v2 interface{}) interface{} {
+			return v1.(string)[:substringLength(v1.(string), v2.(int64))]
 		},
 	}),
-	"right": operatorBinary(binaryActions{ // Правая часть строки
-		two{reflect.String, reflect.Int64}: func(v1, v2 interface{}) interface{} {
+	"right": operatorBinary(reflect.String, BinaryActions{ // Правая часть строки
+		Two{reflect.String, reflect.Int64}: func(v1, v2 interface{}) interface{} {
 			temp := v1.(string)
-			return temp[int64(len(temp))-v2.(int64):]
+			return temp[int64(len(temp))-substringLength(temp, v2.(int64)):]
 		},
 	}),
-	"timeFormat": operatorBinary(binaryActions{ // Преобразование числовой метки времени в запись даты/времени
-		two{reflect.String, reflect.Int64}: func(v1, v2 interface{}) interface{} {
+	"timeFormat": operatorBinary(reflect.String, BinaryActions{ // Преобразование числовой метки времени в запись даты/времени
+		Two{reflect.String, reflect.Int64}: func(v1, v2 interface{}) interface{} {
 			return time.Unix(v2.(int64), 0).Format(v1.(string))
 		},
 	}),
 
 	// Бинарные операции: срока, значение -> строка
-	"format": operatorBinary(binaryActions{ // Форматирование значения
-		two{reflect.String, reflect.Int64}: func(v1, v2 interface{}) interface{} {
+	"format": operatorLimited(guardFormat, operatorBinary(reflect.String, BinaryActions{ // Форматирование значения
+		Two{reflect.String, reflect.Int64}: func(v1, v2 interface{}) interface{} {
 			return fmt.Sprintf("%"+v1.(string), v2.(int64))
 		},
-		two{reflect.String, reflect.Float64}: func(v1, v2 interface{}) interface{} {
+		Two{reflect.String, reflect.Float64}: func(v1, v2 interface{}) interface{} {
 			return fmt.Sprintf("%"+v1.(string), v2.(float64))
 		},
-		two{reflect.String, reflect.String}: func(v1, v2 interface{}) interface{} {
+		Two{reflect.String, reflect.String}: func(v1, v2 interface{}) interface{} {
 			return fmt.Sprintf("%"+v1.(string), v2.(string))
 		},
-	}),
+		Two{reflect.String, reflect.Bool}: func(v1, v2 interface{}) interface{} {
+			return fmt.Sprintf("%"+v1.(string), v2.(bool))
+		},
+	})),
 
 	// Тернарные операции строка, строка, строка -> строка
-	"replace": operatorTernary(ternaryActions{ // Замена подстроки
-		three{reflect.String, reflect.String, reflect.String}: func(v1, v2, v3 interface{}) interface{} {
+	"replace": operatorLimited(guardReplace, operatorTernary(reflect.String, TernaryActions{ // Замена подстроки
+		Three{reflect.String, reflect.String, reflect.String}: func(v1, v2, v3 interface{}) interface{} {
 			return strings.ReplaceAll(v3.(string), v1.(string), v2.(string))
 		},
-	}),
-	"regexReplace": operatorTernary(ternaryActions{ // Замена регулярного выражения
-		three{reflect.String, reflect.String, reflect.String}: func(v1, v2, v3 interface{}) interface{} {
+	})),
+	"regexReplace": operatorLimited(guardRegexReplace, operatorTernary(reflect.String, TernaryActions{ // Замена регулярного выражения
+		Three{reflect.String, reflect.String, reflect.String}: func(v1, v2, v3 interface{}) interface{} {
 			if regex, err := regexp.Compile(v1.(string)); err != nil {
-				panic(err)
+				panic(failure(ErrOperand, err))
 			} else {
 				return regex.ReplaceAllString(v3.(string), v2.(string))
 			}
 		},
-	}),
+	})),
 }
 
 // convertBool преобразует значение типа bool в int64: false -> 0, true -> 1
@@ -403,16 +549,95 @@ func convertBool(flg bool) int64 {
 	}
 }
 
-// getArgument получает значение параметра выражения по его имени - с преобразованием его значения в допустимый тип
-func getArgument(value interface{}) interface{} {
-	switch value := reflect.Indirect(reflect.ValueOf(value)); value.Kind() {
+// substringLength проверяет длину выделяемой части строки str
+func substringLength(str string, length int64) int64 {
+	if length < 0 || length > int64(len(str)) {
+		panic(failure(ErrOperand, fmt.Errorf("substring length %d is out of range", length)))
+	}
+	return length
+}
+
+// getArgument получает значение параметра выражения по его имени - с преобразованием его значения в допустимый тип:
+//   - целые числа любых, в том числе именованных, типов; беззнаковые - не больше максимального значения int64;
+//   - числа с плавающей точкой, строки и логические значения любых типов;
+//   - json.Number - в целое число или, если это невозможно, в число с плавающей точкой;
+//   - time.Time - в числовую метку времени (как timeParse), time.Duration - в количество секунд с дробной частью;
+//   - значения, реализующие encoding.TextMarshaler или fmt.Stringer, - в строку.
+//
+// Указатели и интерфейсы любого уровня вложенности разыменовываются
+func getArgument(name string, value interface{}) interface{} {
+	switch value.(type) {
+	case int64, float64, string, bool:
+		return value
+	}
+	arg := indirect(value)
+	if !arg.IsValid() {
+		panic(failure(ErrParameter, fmt.Errorf("argument %#v is nil", name)))
+	}
+
+	switch value := arg.Interface().(type) {
+	case json.Number:
+		if result, err := value.Int64(); err == nil {
+			return result
+		} else if result, err := value.Float64(); err == nil {
+			return result
+		}
+		panic(failure(ErrParameter, fmt.Errorf("argument %#v number %#v is not valid", name, value.String())))
+	case time.Time:
+		return value.Unix()
+	case time.Duration:
+		return value.Seconds()
+	}
+	switch arg.Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		return value.Int()
+		return arg.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if arg.Uint() > math.MaxInt64 {
+			panic(failure(ErrParameter, fmt.Errorf("argument %#v value %d overflows int64", name, arg.Uint())))
+		}
+		return int64(arg.Uint())
 	case reflect.Float32, reflect.Float64:
-		return value.Float()
+		return arg.Float()
 	case reflect.String:
+		return arg.String()
+	case reflect.Bool:
+		return arg.Bool()
+	}
+
+	// Методы могут быть определены для указателя на значение
+	ptr := reflect.New(arg.Type())
+	ptr.Elem().Set(arg)
+	switch value := ptr.Interface().(type) {
+	case encoding.TextMarshaler:
+		text, err := value.MarshalText()
+		if err != nil {
+			panic(failure(ErrParameter, fmt.Errorf("argument %#v: %v", name, err)))
+		}
+		return string(text)
+	case fmt.Stringer:
 		return value.String()
-	default:
-		panic(errors.New("argument type is not valid"))
 	}
+	panic(failure(ErrParameter, fmt.Errorf("argument %#v type %v is not valid", name, arg.Type())))
+}
+
+// indirect разыменовывает указатели и интерфейсы любого уровня вложенности в значении value
+// Возвращает недействительное значение, если value или какой-либо из указателей равен nil
+func indirect(value interface{}) reflect.Value {
+	arg := reflect.ValueOf(value)
+	for arg.Kind() == reflect.Ptr || arg.Kind() == reflect.Interface {
+		if arg.IsNil() {
+			return reflect.Value{}
+		}
+		arg = arg.Elem()
+	}
+	return arg
+}
+
+// isNil проверяет, что значение параметра value равно nil (в том числе является указателем, равным nil)
+func isNil(value interface{}) bool {
+	switch value.(type) {
+	case int64, float64, string, bool:
+		return false
+	}
+	return !indirect(value).IsValid()
 }
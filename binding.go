@@ -0,0 +1,190 @@
+package scalc
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// ExecObject выполняет выражение calc с параметрами, заданными структурой или словарём data (в том числе вложенными),
+// и возвращает единственное значение
+// Параметры выражения являются составными именами через точку (order.customer.tier @): каждая часть имени - ключ словаря
+// или имя поля структуры. Имя поля может быть задано тегом scalc:"name" или json:"name"; поля с тегом "-"
+// и неэкспортируемые поля недоступны, экспортируемые поля встроенных структур (в том числе неэкспортируемых типов)
+// доступны по собственным именам
+func (calc *Calculators) ExecObject(data interface{}) (result interface{}, err error) {
+	return calc.ExecObjectContext(context.Background(), data)
+}
+
+// ExecObjectContext работает аналогично ExecObject, но прерывает выполнение выражения
+// при отмене или истечении срока контекста ctx
+func (calc *Calculators) ExecObjectContext(ctx context.Context, data interface{}) (result interface{}, err error) {
+	return calc.single(ctx, calc.acquireObject(data))
+}
+
+// ExecObjectToSlice работает аналогично ExecObject, но возвращает все значения,
+// находящиеся в стеке после завершения выполнения выражения
+func (calc *Calculators) ExecObjectToSlice(data interface{}) (result []interface{}, err error) {
+	return calc.ExecObjectToSliceContext(context.Background(), data)
+}
+
+// ExecObjectToSliceContext работает аналогично ExecObjectToSlice, но прерывает выполнение выражения
+// при отмене или истечении срока контекста ctx
+func (calc *Calculators) ExecObjectToSliceContext(ctx context.Context, data interface{}) (result []interface{}, err error) {
+	return calc.slice(ctx, calc.acquireObject(data))
+}
+
+// acquireObject получает из pool исполнителя для выражения calc с параметрами в структуре или словаре data
+func (calc *Calculators) acquireObject(data interface{}) *does {
+	if args, ok := data.(map[string]interface{}); ok {
+		return calc.acquire(args)
+	}
+	do := calc.acquire(nil)
+	do.object = data
+	return do
+}
+
+// argument возвращает значение параметра name: значение с таким именем из набора параметров либо,
+// если его нет, значение, найденное по составному имени во вложенных словарях и структурах
+// Возвращает false, если параметр не найден
+func (do *does) argument(name string) (interface{}, bool) {
+	if value, exists := do.args[name]; exists {
+		return value, true
+	} else if do.object != nil {
+		return lookup(do.object, name)
+	}
+	return lookup(do.args, name)
+}
+
+// lookup находит значение по составному имени path (через точку) в словаре или структуре data
+// Ключ словаря, совпадающий с оставшейся частью имени целиком, имеет приоритет перед разбиением имени на части
+func lookup(data interface{}, path string) (interface{}, bool) {
+	value := reflect.ValueOf(data)
+	for {
+		if result, exists := member(value, path); exists {
+			if !result.IsValid() {
+				return nil, true
+			}
+			return result.Interface(), true
+		}
+		pos := strings.IndexByte(path, '.')
+		if pos < 0 {
+			return nil, false
+		}
+		next, exists := member(value, path[:pos])
+		if !exists {
+			return nil, false
+		}
+		value, path = next, path[pos+1:]
+	}
+}
+
+// member возвращает значение ключа словаря или поля структуры value с именем name
+// Указатели и интерфейсы разыменовываются
+func member(value reflect.Value, name string) (reflect.Value, bool) {
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return reflect.Value{}, false
+		}
+		value = value.Elem()
+	}
+	switch value.Kind() {
+	case reflect.Map:
+		if data, ok := value.Interface().(map[string]interface{}); ok {
+			result, exists := data[name]
+			return reflect.ValueOf(result), exists
+		} else if value.Type().Key().Kind() != reflect.String {
+			return reflect.Value{}, false
+		}
+		result := value.MapIndex(reflect.ValueOf(name).Convert(value.Type().Key()))
+		return result, result.IsValid()
+	case reflect.Struct:
+		index, exists := fieldsOf(value.Type())[name]
+		if !exists {
+			return reflect.Value{}, false
+		}
+		for _, key := range index {
+			if value.Kind() == reflect.Ptr {
+				if value.IsNil() {
+					return reflect.Value{}, false
+				}
+				value = value.Elem()
+			}
+			value = value.Field(key)
+		}
+		return value, true
+	}
+	return reflect.Value{}, false
+}
+
+// fields содержит индексы доступных полей структур по их именам (см. fieldsOf) для каждого типа структуры
+var fields sync.Map
+
+// fieldsOf возвращает индексы доступных полей структуры kind (см. reflect.Value.FieldByIndex) по их именам
+// Результат сохраняется для каждого типа структуры, поэтому анализ структуры выполняется однократно
+func fieldsOf(kind reflect.Type) map[string][]int {
+	if result, exists := fields.Load(kind); exists {
+		return result.(map[string][]int)
+	}
+	result := map[string][]int{}
+	collectFields(kind, nil, result, map[reflect.Type]bool{})
+	fields.Store(kind, result)
+	return result
+}
+
+// collectFields добавляет в result поля структуры kind, вложенной по индексу index
+// Поля внешней структуры имеют приоритет перед одноимёнными полями встроенных структур
+func collectFields(kind reflect.Type, index []int, result map[string][]int, visited map[reflect.Type]bool) {
+	visited[kind] = true
+	embedded := []int{}
+	for key := 0; key < kind.NumField(); key++ {
+		field := kind.Field(key)
+		embeddable := field.Anonymous && structType(field.Type) != nil
+		if field.PkgPath != "" && !embeddable {
+			continue
+		}
+		// Встроенная структура неэкспортируемого типа недоступна по имени, но её поля доступны, как в encoding/json
+		name := fieldName(field)
+		if name == "-" {
+			continue
+		} else if name == "" || field.PkgPath != "" {
+			if embeddable {
+				embedded = append(embedded, key)
+				continue
+			}
+			name = field.Name
+		}
+		if _, exists := result[name]; !exists {
+			result[name] = append(append([]int{}, index...), key)
+		}
+	}
+	for _, key := range embedded {
+		if inner := structType(kind.Field(key).Type); !visited[inner] {
+			collectFields(inner, append(append([]int{}, index...), key), result, visited)
+		}
+	}
+}
+
+// fieldName возвращает имя поля field, заданное тегом scalc или json, либо пустую строку, если имя не задано
+func fieldName(field reflect.StructField) string {
+	for _, key := range []string{"scalc", "json"} {
+		if tag, exists := field.Tag.Lookup(key); exists {
+			if name := strings.Split(tag, ",")[0]; name != "" {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// structType возвращает тип структуры kind или структуры, на которую указывает kind, либо nil для прочих типов
+func structType(kind reflect.Type) reflect.Type {
+	if kind.Kind() == reflect.Ptr {
+		kind = kind.Elem()
+	}
+	if kind.Kind() != reflect.Struct {
+		return nil
+	}
+	return kind
+}
@@ -0,0 +1,312 @@
+package scalc
+
+import "fmt"
+
+// opcodes определяет код инструкции программы калькулятора
+type opcodes uint8
+
+const (
+	opOperation opcodes = iota // выполнение операции из набора операций окружения
+	opConstant                 // запись в стек значения константы
+	opJump                     // безусловный переход
+	opJumpFalse                // переход, если значение из вершины стека ложно (? [ then ; else ])
+	opSwitch                   // переход по таблице переходов в соответствии с индексом из вершины стека ([ a ; b ; c ])
+	opTimes                    // начало цикла с заданным количеством повторений (times [ body ])
+	opNext                     // окончание тела цикла с заданным количеством повторений
+	opEnter                    // начало цикла с условием (while [ cond ; body ])
+	opWhile                    // проверка условия цикла с условием
+	opCall                     // вызов пользовательского слова
+	opReturn                   // возврат из пользовательского слова или завершение программы
+	opStore                    // сохранение значения в локальной переменной (!name, ->name)
+	opFetch                    // запись в стек значения локальной переменной ($name)
+	opOutput                   // сохранение значения в выходном параметре (=>name)
+)
+
+// instructions определяет инструкцию программы калькулятора: код, операнды и положение соответствующей лексемы
+type instructions struct {
+	positions
+	code     opcodes
+	exec     operators   // исполнение операции (для opOperation)
+	value    interface{} // значение константы (для opConstant) или имя переменной (для opStore, opFetch, opOutput)
+	jump     int         // смещение перехода относительно следующей инструкции (для переходов, циклов и opCall)
+	table    []int       // смещения вариантов и (последнее) окончания ветвления относительно следующей инструкции (для opSwitch)
+	fallback bool        // последний вариант является вариантом по умолчанию (для opSwitch)
+}
+
+// compilers определяет компилятор дерева разбора в программу калькулятора
+type compilers struct {
+	code  []instructions // программа калькулятора
+	words []*words       // пользовательские слова, тела которых размещаются после основной программы
+	calls map[int]*words // адреса инструкций opCall и вызываемые ими слова
+}
+
+// compile преобразует дерево разбора в программу калькулятора - плоскую последовательность инструкций
+// Тела пользовательских слов размещаются после основной программы и вызываются инструкцией opCall
+func compile(tree []nodes) []instructions {
+	cmp := compilers{code: make([]instructions, 0, len(tree)+1), calls: map[int]*words{}}
+	cmp.tree(tree)
+	cmp.emit(instructions{positions: positions{"", -1, -1}, code: opReturn})
+	entries := make(map[*words]int, len(cmp.words))
+	for _, word := range cmp.words {
+		entries[word] = len(cmp.code)
+		cmp.tree(word.body)
+		cmp.emit(instructions{positions: positions{"", -1, -1}, code: opReturn})
+	}
+	for address, word := range cmp.calls {
+		cmp.code[address].jump = entries[word] - address - 1
+	}
+	return cmp.code
+}
+
+// emit добавляет инструкцию в программу и возвращает её адрес
+func (cmp *compilers) emit(in instructions) int {
+	cmp.code = append(cmp.code, in)
+	return len(cmp.code) - 1
+}
+
+// target устанавливает смещение перехода инструкции с адресом address на следующую добавляемую инструкцию
+func (cmp *compilers) target(address int) {
+	cmp.code[address].jump = len(cmp.code) - address - 1
+}
+
+// tree добавляет в программу инструкции элементов дерева разбора
+func (cmp *compilers) tree(tree []nodes) {
+	for _, node := range tree {
+		switch node.kind {
+		case nodeConstant:
+			cmp.emit(instructions{positions: node.positions, code: opConstant, value: node.value})
+		case nodeOperation:
+			cmp.emit(instructions{positions: node.positions, code: opOperation, exec: node.op.exec})
+		case nodeSelect:
+			address := cmp.emit(instructions{positions: node.positions, code: opSwitch, fallback: node.fallback})
+			table := make([]int, len(node.branches)+1)
+			jumps := make([]int, 0, len(node.branches))
+			for key, branch := range node.branches {
+				table[key] = len(cmp.code) - address - 1
+				cmp.tree(branch)
+				if key < len(node.branches)-1 {
+					jumps = append(jumps, cmp.emit(instructions{positions: node.positions, code: opJump}))
+				}
+			}
+			for _, jump := range jumps {
+				cmp.target(jump)
+			}
+			table[len(node.branches)] = len(cmp.code) - address - 1
+			cmp.code[address].table = table
+		case nodeCondition:
+			address := cmp.emit(instructions{positions: node.positions, code: opJumpFalse})
+			cmp.tree(node.branches[0])
+			if len(node.branches) > 1 {
+				jump := cmp.emit(instructions{positions: node.positions, code: opJump})
+				cmp.target(address)
+				cmp.tree(node.branches[1])
+				cmp.target(jump)
+			} else {
+				cmp.target(address)
+			}
+		case nodeTimes:
+			address := cmp.emit(instructions{positions: node.positions, code: opTimes})
+			cmp.tree(node.branches[0])
+			cmp.emit(instructions{positions: node.positions, code: opNext, jump: address - len(cmp.code)})
+			cmp.target(address)
+		case nodeWhile:
+			start := cmp.emit(instructions{positions: node.positions, code: opEnter}) + 1
+			cmp.tree(node.branches[0])
+			address := cmp.emit(instructions{positions: node.positions, code: opWhile})
+			cmp.tree(node.branches[1])
+			cmp.emit(instructions{positions: node.positions, code: opJump, jump: start - len(cmp.code) - 1})
+			cmp.target(address)
+		case nodeDefinition:
+			cmp.words = append(cmp.words, node.word)
+		case nodeCall:
+			cmp.calls[cmp.emit(instructions{positions: node.positions, code: opCall})] = node.word
+		case nodeStore:
+			cmp.emit(instructions{positions: node.positions, code: opStore, value: node.value})
+		case nodeFetch:
+			cmp.emit(instructions{positions: node.positions, code: opFetch, value: node.value})
+		case nodeOutput:
+			cmp.emit(instructions{positions: node.positions, code: opOutput, value: node.value})
+		}
+	}
+}
+
+// exec выполняет программу калькулятора
+// Инструкции библиотечных слов не отслеживаются: ошибки в них относятся к лексеме вызова слова
+func (do *does) exec(program []instructions) {
+	base := len(do.returns)
+	for pc := 0; pc < len(program); {
+		pc = do.execute(program, pc, base)
+	}
+}
+
+// execute выполняет инструкцию программы с адресом pc и возвращает адрес следующей инструкции
+// (len(program) по завершении программы). base - глубина вызовов слов, на которой выполняется программа
+func (do *does) execute(program []instructions, pc, base int) int {
+	in := &program[pc]
+	if do.hidden == 0 {
+		do.step = in
+		if do.tracer != nil {
+			do.trace(in, false, nil)
+		}
+	}
+	if do.done != nil {
+		select {
+		case <-do.done:
+			panic(failure(ErrCanceled, do.ctx.Err()))
+		default:
+		}
+	}
+	switch in.code {
+	case opOperation:
+		in.exec(do)
+	case opConstant:
+		do.stack = append(do.stack, in.value)
+	case opJump:
+		pc += in.jump
+	case opJumpFalse:
+		if !truthy(do.pop()) {
+			pc += in.jump
+		}
+	case opSwitch:
+		pc += in.table[do.index(len(in.table)-1, in.fallback)]
+	case opTimes:
+		if count := do.count(); count == 0 {
+			pc += in.jump
+		} else {
+			do.counts = append(do.counts, count)
+		}
+	case opNext:
+		last := len(do.counts) - 1
+		if do.counts[last]--; do.counts[last] > 0 {
+			pc += in.jump
+		} else {
+			do.counts = do.counts[:last]
+		}
+	case opEnter:
+		do.counts = append(do.counts, 0)
+	case opWhile:
+		last := len(do.counts) - 1
+		if !truthy(do.pop()) {
+			do.counts = do.counts[:last]
+			pc += in.jump
+		} else if do.counts[last] >= do.loops {
+			panic(failure(ErrLoopLimit, fmt.Errorf("loop exceeds limit %d", do.loops)))
+		} else {
+			do.counts[last]++
+		}
+	case opCall:
+		do.returns = append(do.returns, pc)
+		pc += in.jump
+	case opReturn:
+		last := len(do.returns) - 1
+		if last < base {
+			pc = len(program) - 1
+		} else {
+			pc = do.returns[last]
+			do.returns = do.returns[:last]
+		}
+	case opStore:
+		value := do.pop()
+		if do.locals == nil {
+			do.locals = make(map[string]interface{})
+		}
+		do.locals[in.value.(string)] = value
+	case opFetch:
+		value, exists := do.locals[in.value.(string)]
+		if !exists {
+			panic(failure(ErrParameter, fmt.Errorf("local %#v is not set", in.value)))
+		}
+		do.stack = append(do.stack, value)
+	case opOutput:
+		value := do.pop()
+		if do.output == nil {
+			do.output = make(map[string]interface{})
+		}
+		do.output[in.value.(string)] = value
+	}
+	if do.limits != nil {
+		do.limit()
+	}
+	if do.tracer != nil && do.hidden == 0 {
+		do.trace(in, true, nil)
+	}
+	return pc + 1
+}
+
+// blockEnd возвращает адрес инструкции, следующей за ветвлением или циклом, начинающимся инструкцией с адресом pc,
+// либо адрес следующей инструкции для остальных инструкций
+func blockEnd(program []instructions, pc int) int {
+	in := &program[pc]
+	switch in.code {
+	case opSwitch:
+		return pc + 1 + in.table[len(in.table)-1]
+	case opJumpFalse:
+		end := pc + 1 + in.jump
+		if end > pc+1 && program[end-1].code == opJump && program[end-1].jump >= 0 && program[end-1].positions == in.positions {
+			end += program[end-1].jump
+		}
+		return end
+	case opTimes:
+		return pc + 1 + in.jump
+	case opEnter:
+		for address := pc + 1; address < len(program); address++ {
+			if check := &program[address]; check.code == opWhile && check.positions == in.positions {
+				return address + 1 + check.jump
+			}
+		}
+	}
+	return pc + 1
+}
+
+// pop извлекает значение из вершины стека
+func (do *does) pop() interface{} {
+	do.need(1)
+	last := len(do.stack) - 1
+	value := do.stack[last]
+	do.stack = do.stack[:last]
+	return value
+}
+
+// index извлекает из вершины стека индекс варианта ветвления (switch) из count вариантов
+// Логическое значение индекса варианта преобразуется в целое: false -> 0, true -> 1
+// Если fallback - последний вариант выбирается при индексе вне диапазона остальных вариантов
+func (do *does) index(count int, fallback bool) int {
+	do.need(1)
+	last := len(do.stack) - 1
+	var code int64
+	switch value := do.stack[last].(type) {
+	case int64:
+		code = value
+	case bool:
+		code = convertBool(value)
+	default:
+		panic(failure(ErrTypeMismatch, fmt.Errorf("switch index type %v is not valid", kindOf(value))))
+	}
+	if fallback {
+		count--
+	}
+	if code < 0 || code >= int64(count) {
+		if !fallback {
+			panic(failure(ErrOperand, fmt.Errorf("switch index %d is out of range", code)))
+		}
+		code = int64(count)
+	}
+	do.stack = do.stack[:last]
+	return int(code)
+}
+
+// count извлекает из вершины стека количество повторений цикла times
+func (do *does) count() int {
+	do.need(1)
+	last := len(do.stack) - 1
+	count, ok := do.stack[last].(int64)
+	if !ok {
+		panic(mismatch(kindOf(do.stack[last])))
+	} else if count < 0 {
+		panic(failure(ErrOperand, fmt.Errorf("loop count %d is negative", count)))
+	} else if count > int64(do.loops) {
+		panic(failure(ErrLoopLimit, fmt.Errorf("loop count %d exceeds limit %d", count, do.loops)))
+	}
+	do.stack = do.stack[:last]
+	return int(count)
+}
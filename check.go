@@ -0,0 +1,210 @@
+package scalc
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+const (
+	// Any обозначает значение любого типа, в том числе значение, тип которого не может быть определён статически
+	// (например, значение параметра)
+	Any = reflect.Interface
+	// Same обозначает, что тип результата операции совпадает с типом её первого аргумента
+	Same = reflect.Invalid
+)
+
+// checks определяет статический контролёр выражения: моделирует глубину стека и типы значений
+type checks struct {
+	stack []reflect.Kind // модель стека интерпретатора выражения
+}
+
+// check выполняет статическую проверку дерева разбора выражения
+// Ошибки проверки возвращаются в виде *Error
+func check(tree []nodes) error {
+	chk := checks{make([]reflect.Kind, 0, 16)}
+	if err := chk.run(tree); err != nil {
+		return err
+	}
+	return nil
+}
+
+// run моделирует выполнение последовательности элементов дерева разбора
+func (chk *checks) run(tree []nodes) (err *Error) {
+	for _, node := range tree {
+		switch node.kind {
+		case nodeConstant:
+			chk.push(reflect.TypeOf(node.value).Kind())
+		case nodeOperation:
+			err = node.op.check(chk)
+		case nodeSelect:
+			err = chk.selects(node.branches)
+		case nodeCondition:
+			err = chk.condition(node.branches)
+		case nodeTimes:
+			err = chk.times(node.branches[0])
+		case nodeWhile:
+			err = chk.loop(node.branches[0], node.branches[1])
+		case nodeCall:
+			err = chk.run(node.word.body)
+		case nodeStore, nodeOutput:
+			_, err = chk.pop(1)
+		case nodeFetch:
+			chk.push(Any)
+		}
+		if err != nil {
+			return err.at(node.positions)
+		}
+	}
+	return
+}
+
+// push помещает в модель стека типы значений
+func (chk *checks) push(kinds ...reflect.Kind) {
+	chk.stack = append(chk.stack, kinds...)
+}
+
+// pop извлекает из модели стека типы count значений
+func (chk *checks) pop(count int) ([]reflect.Kind, *Error) {
+	last := len(chk.stack) - count
+	if last < 0 {
+		return nil, failure(ErrStackUnderflow, fmt.Errorf("%d values required, %d available", count, len(chk.stack)))
+	}
+	result := append([]reflect.Kind(nil), chk.stack[last:]...)
+	chk.stack = chk.stack[:last]
+	return result, nil
+}
+
+// operands проверяет типы count верхних значений стека по набору допустимых сигнатур операции
+// и помещает в модель стека тип результата
+func (chk *checks) operands(count int, result reflect.Kind, signatures [][]reflect.Kind) *Error {
+	kinds, err := chk.pop(count)
+	if err != nil {
+		return err
+	}
+	found := false
+	kind := Any
+	for _, signature := range signatures {
+		if !matchKinds(kinds, signature) {
+			continue
+		}
+		temp := result
+		if temp == Same {
+			temp = signature[0]
+		}
+		if !found {
+			kind = temp
+			found = true
+		} else if kind != temp {
+			kind = Any
+		}
+	}
+	if !found {
+		return mismatch(kinds...)
+	}
+	chk.push(kind)
+	return nil
+}
+
+// selects моделирует выполнение ветвления по индексу
+func (chk *checks) selects(branches [][]nodes) *Error {
+	kinds, err := chk.pop(1)
+	if err != nil {
+		return err
+	}
+	if kinds[0] != reflect.Int64 && kinds[0] != reflect.Bool && kinds[0] != Any {
+		return failure(ErrTypeMismatch, fmt.Errorf("switch index type %v is not valid", kinds[0]))
+	}
+	return chk.branches(branches)
+}
+
+// condition моделирует выполнение условного ветвления; отсутствующий вариант для ложного условия считается пустым
+func (chk *checks) condition(branches [][]nodes) *Error {
+	if _, err := chk.pop(1); err != nil {
+		return err
+	}
+	if len(branches) == 1 {
+		branches = [][]nodes{branches[0], nil}
+	}
+	return chk.branches(branches)
+}
+
+// branches моделирует выполнение вариантов ветвления: все варианты должны иметь одинаковый стековый эффект
+func (chk *checks) branches(branches [][]nodes) *Error {
+	start := chk.stack
+	var result []reflect.Kind
+	for key, branch := range branches {
+		chk.stack = append([]reflect.Kind(nil), start...)
+		if err := chk.run(branch); err != nil {
+			return err
+		}
+		if key == 0 {
+			result = chk.stack
+		} else if len(result) != len(chk.stack) {
+			return failure(ErrStackEffect, errors.New("branches have different stack effects"))
+		} else {
+			for pos, kind := range chk.stack {
+				if result[pos] != kind {
+					result[pos] = Any
+				}
+			}
+		}
+	}
+	chk.stack = result
+	return nil
+}
+
+// times моделирует выполнение цикла с заданным количеством повторений
+func (chk *checks) times(body []nodes) *Error {
+	kinds, err := chk.pop(1)
+	if err != nil {
+		return err
+	} else if kinds[0] != reflect.Int64 && kinds[0] != Any {
+		return failure(ErrTypeMismatch, fmt.Errorf("loop count type %v is not valid", kinds[0]))
+	}
+	return chk.loop(nil, body)
+}
+
+// loop моделирует выполнение цикла: условие cond (если задано) должно помещать в стек одно значение,
+// а тело цикла body - сохранять глубину стека. Типы значений, изменяемые телом цикла, считаются неопределёнными
+func (chk *checks) loop(cond, body []nodes) *Error {
+	start := chk.stack
+	for {
+		chk.stack = append([]reflect.Kind(nil), start...)
+		if cond != nil {
+			if err := chk.run(cond); err != nil {
+				return err
+			} else if _, err = chk.pop(1); err != nil {
+				return err
+			} else if len(chk.stack) != len(start) {
+				return failure(ErrStackEffect, errors.New("loop condition must push exactly one value"))
+			}
+		}
+		if err := chk.run(body); err != nil {
+			return err
+		} else if len(chk.stack) != len(start) {
+			return failure(ErrStackEffect, errors.New("loop body changes stack depth"))
+		}
+		changed := false
+		for pos, kind := range chk.stack {
+			if start[pos] != kind && start[pos] != Any {
+				start[pos] = Any
+				changed = true
+			}
+		}
+		if !changed {
+			chk.stack = start
+			return nil
+		}
+	}
+}
+
+// matchKinds проверяет соответствие типов значений сигнатуре операции
+func matchKinds(kinds, signature []reflect.Kind) bool {
+	for key, kind := range kinds {
+		if kind != Any && signature[key] != Any && kind != signature[key] {
+			return false
+		}
+	}
+	return true
+}
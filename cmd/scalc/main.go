@@ -0,0 +1,400 @@
+// Команда scalc вычисляет выражения калькулятора, заданные аргументами, файлами или стандартным вводом,
+// и выводит значения, оставшиеся в стеке. В интерактивном режиме (-i) выражения читаются построчно,
+// стек сохраняется между строками (кроме инфиксных выражений, -infix) и выводится после каждой строки
+//
+// Использование:
+//
+//	scalc [-p name=value]... [-params file.json] [-f file]... [-check] [-infix] [-trace] [-i] [expr ...]
+//
+// При ошибке выводит её описание (категорию, положение лексемы и снимок стека) и завершается с кодом 1
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil" // os.ReadFile и io.ReadAll недоступны в Go 1.12
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"scalc"
+)
+
+// коды завершения команды
+const (
+	exitFailure = 1 // ошибка разбора или выполнения выражения
+	exitUsage   = 2 // недопустимые аргументы командной строки
+)
+
+// params определяет набор параметров выражения, заданных флагами -p name=value
+type params map[string]interface{}
+
+// String возвращает описание набора параметров
+func (p params) String() string {
+	return fmt.Sprint(map[string]interface{}(p))
+}
+
+// Set добавляет параметр, заданный в виде name=value
+// Значение разбирается как константа выражения: целое, число с плавающей точкой, true/false или строка
+// (строка с кавычкой в начале всегда считается строкой)
+func (p params) Set(arg string) error {
+	pos := strings.IndexByte(arg, '=')
+	if pos < 1 {
+		return fmt.Errorf("parameter %#v must be name=value", arg)
+	}
+	p[arg[:pos]] = parseValue(arg[pos+1:])
+	return nil
+}
+
+// files определяет список файлов с выражениями, заданных флагами -f
+type files []string
+
+// String возвращает описание списка файлов
+func (f *files) String() string {
+	return strings.Join(*f, ",")
+}
+
+// Set добавляет файл в список
+func (f *files) Set(name string) error {
+	*f = append(*f, name)
+	return nil
+}
+
+// options определяет настройки выполнения команды
+type options struct {
+	env     *scalc.Environment
+	data    map[string]interface{}
+	checked bool
+	infix   bool
+	trace   bool
+	stdout  io.Writer
+	stderr  io.Writer
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run выполняет команду с аргументами args и возвращает код завершения
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("scalc", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	values := params{}
+	sources := files{}
+	flags.Var(values, "p", "expression parameter `name=value` (repeatable)")
+	flags.Var(&sources, "f", "read expression from `file` (repeatable)")
+	paramsFile := flags.String("params", "", "read expression parameters from JSON `file`")
+	checked := flags.Bool("check", false, "statically check expressions before execution")
+	infix := flags.Bool("infix", false, "expressions are infix, e.g. (price * qty) - discount")
+	trace := flags.Bool("trace", false, "write step-by-step execution trace to stderr")
+	interactive := flags.Bool("i", false, "interactive mode: read expressions line by line and show the stack")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	data := map[string]interface{}{}
+	if *paramsFile != "" {
+		temp, err := readParams(*paramsFile)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+		data = temp
+	}
+	for name, value := range values {
+		data[name] = value
+	}
+	opt := &options{env: scalc.NewEnvironment(), data: data, checked: *checked, infix: *infix, trace: *trace, stdout: stdout, stderr: stderr}
+
+	exprs := flags.Args()
+	for _, name := range sources {
+		text, err := ioutil.ReadFile(name)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+		exprs = append(exprs, string(text))
+	}
+	if *interactive {
+		for _, expr := range exprs {
+			if code := opt.eval(expr); code != 0 {
+				return code
+			}
+		}
+		return opt.repl(stdin)
+	}
+	if len(exprs) == 0 {
+		text, err := ioutil.ReadAll(stdin)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+		exprs = append(exprs, string(text))
+	}
+	for _, expr := range exprs {
+		if code := opt.eval(expr); code != 0 {
+			return code
+		}
+	}
+	return 0
+}
+
+// eval вычисляет выражение и выводит значения стека
+func (opt *options) eval(expr string) int {
+	stack, err := opt.exec(expr)
+	if err != nil {
+		report(opt.stderr, expr, err)
+		return exitFailure
+	}
+	fmt.Fprintln(opt.stdout, scalc.FormatValues(stack))
+	return 0
+}
+
+// compile создаёт калькулятор выражения
+func (opt *options) compile(expr string) (*scalc.Calculators, error) {
+	if opt.infix {
+		return opt.env.NewInfix(expr)
+	} else if opt.checked {
+		return opt.env.NewChecked(expr)
+	}
+	return opt.env.New(expr)
+}
+
+// exec создаёт калькулятор выражения и выполняет его
+func (opt *options) exec(expr string) ([]interface{}, error) {
+	calc, err := opt.compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	if opt.trace {
+		return calc.ExecTrace(context.Background(), opt.data, scalc.NewTracer(opt.stderr))
+	}
+	return calc.ExecToSlice(opt.data)
+}
+
+// repl построчно читает и вычисляет выражения, сохраняя стек между строками
+// Кроме выражений принимает команды .define name body, .debug expr, .clear, .help и .quit
+func (opt *options) repl(stdin io.Reader) int {
+	var stack []interface{}
+	scanner := bufio.NewScanner(stdin)
+	for fmt.Fprint(opt.stdout, "> "); scanner.Scan(); fmt.Fprint(opt.stdout, "> ") {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case ".quit":
+			return 0
+		case ".clear":
+			stack = nil
+		case ".help":
+			fmt.Fprintln(opt.stdout, "expression   evaluate the expression with the current stack")
+			fmt.Fprintln(opt.stdout, ".define name body   define a word available to the following lines")
+			fmt.Fprintln(opt.stdout, ".debug expr   execute the expression step by step")
+			fmt.Fprintln(opt.stdout, ".clear   clear the stack")
+			fmt.Fprintln(opt.stdout, ".quit   exit")
+			continue
+		case ".define":
+			if len(fields) < 2 {
+				fmt.Fprintln(opt.stdout, "usage: .define name body")
+			} else if err := opt.env.Define(fields[1], strings.Join(fields[2:], " ")); err != nil {
+				report(opt.stdout, strings.Join(fields[2:], " "), err)
+			}
+			continue
+		case ".debug":
+			stack = opt.debug(scanner, strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), ".debug")), stack)
+		default:
+			carried := stack
+			if opt.infix {
+				carried = nil
+			}
+			prefix := scalc.FormatConstants(carried)
+			if prefix != "" {
+				prefix += " "
+			}
+			result, err := opt.exec(prefix + line)
+			if err != nil {
+				report(opt.stdout, line, shift(err, len(carried), len(prefix)))
+				continue
+			}
+			stack = result
+		}
+		fmt.Fprintln(opt.stdout, scalc.FormatValues(stack))
+	}
+	fmt.Fprintln(opt.stdout)
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(opt.stderr, err)
+		return exitFailure
+	}
+	return 0
+}
+
+// debug выполняет выражение expr по шагам с начальным стеком stack, читая команды отладчика из scanner
+// Возвращает стек после успешного завершения выполнения или исходный стек в остальных случаях
+func (opt *options) debug(scanner *bufio.Scanner, expr string, stack []interface{}) []interface{} {
+	calc, err := opt.compile(expr)
+	if err != nil {
+		report(opt.stdout, expr, err)
+		return stack
+	}
+	dbg := calc.Debug(context.Background(), opt.data)
+	defer dbg.Close()
+	if err := dbg.SetStack(stack); err != nil {
+		fmt.Fprintln(opt.stdout, "error:", err)
+		return stack
+	}
+	for opt.position(dbg, expr); !dbg.Done(); opt.position(dbg, expr) {
+		fmt.Fprint(opt.stdout, "debug> ")
+		if !scanner.Scan() {
+			return stack
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			fields = []string{"step"}
+		}
+		switch fields[0] {
+		case "s", "step":
+			dbg.Step()
+		case "n", "next":
+			dbg.StepOver()
+		case "c", "continue":
+			dbg.Continue()
+		case "b", "break":
+			for _, arg := range fields[1:] {
+				if lexeme, err := strconv.Atoi(arg); err == nil {
+					if !dbg.BreakAt(lexeme) {
+						fmt.Fprintf(opt.stdout, "  lexeme %d has no instruction (evaluated by optimization)\n", lexeme)
+					}
+				} else {
+					dbg.BreakOn(arg)
+				}
+			}
+		case "stack":
+		case "set":
+			values := make([]interface{}, len(fields)-1)
+			for key, arg := range fields[1:] {
+				values[key] = parseValue(arg)
+			}
+			dbg.SetStack(values)
+		case "args":
+			args := dbg.Args()
+			names := make([]string, 0, len(args))
+			for name := range args {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				fmt.Fprintf(opt.stdout, "  %s = %#v\n", name, args[name])
+			}
+		case "arg":
+			for _, arg := range fields[1:] {
+				if pos := strings.IndexByte(arg, '='); pos > 0 {
+					dbg.SetArg(arg[:pos], parseValue(arg[pos+1:]))
+				}
+			}
+		case "q", "quit":
+			return stack
+		default:
+			fmt.Fprintln(opt.stdout, "commands: step (s), next (n), continue (c), break (b) lexeme|operator..., stack, set value..., args, arg name=value..., quit (q)")
+		}
+	}
+	result, err := dbg.Result()
+	if err != nil {
+		report(opt.stdout, expr, err)
+		return stack
+	}
+	return result
+}
+
+// position выводит положение, на котором приостановлено пошаговое выполнение выражения expr, и стек
+func (opt *options) position(dbg *scalc.Debugger, expr string) {
+	if step, ok := dbg.Position(); ok {
+		fmt.Fprintf(opt.stdout, "  at lexeme %d (offset %d) %#v %s\n  %s\n  %s^\n  stack: %s\n", step.Lexeme, step.Offset, step.Operator, step.Code,
+			expr, strings.Repeat(" ", len([]rune(expr[:step.Offset]))), scalc.FormatValues(step.Stack))
+	}
+}
+
+// shift смещает положение ошибки на count лексем и length байт, добавленных перед строкой выражения
+func shift(err error, count, length int) error {
+	if temp, ok := err.(*scalc.Error); ok && temp.Lexeme >= count {
+		temp.Lexeme -= count
+		temp.Offset -= length
+	}
+	return err
+}
+
+// report выводит описание ошибки: текст, строку выражения с указателем на лексему и снимок стека
+func report(out io.Writer, expr string, err error) {
+	fmt.Fprintln(out, "error:", err)
+	temp, ok := err.(*scalc.Error)
+	if !ok {
+		return
+	}
+	if temp.Offset >= 0 && temp.Offset <= len(expr) && !strings.Contains(expr, "\n") {
+		fmt.Fprintf(out, "  %s\n  %s^\n", expr, strings.Repeat(" ", len([]rune(expr[:temp.Offset]))))
+	}
+	if len(temp.Stack) > 0 {
+		fmt.Fprintln(out, "  stack:", scalc.FormatValues(temp.Stack))
+	}
+}
+
+// parseValue разбирает значение параметра командной строки
+func parseValue(value string) interface{} {
+	if strings.HasPrefix(value, "'") {
+		return value[1:]
+	} else if result, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return result
+	} else if result, err := strconv.ParseFloat(value, 64); err == nil {
+		return result
+	} else if value == "true" || value == "false" {
+		return value == "true"
+	}
+	return value
+}
+
+// readParams читает параметры выражения из JSON-файла, содержащего объект
+// Числа преобразуются в int64, если они являются целыми, и в float64 в остальных случаях
+func readParams(name string) (map[string]interface{}, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	decoder.UseNumber()
+	data := map[string]interface{}{}
+	if err := decoder.Decode(&data); err != nil {
+		return nil, fmt.Errorf("parameters file %s: %v", name, err)
+	}
+	for name, value := range data {
+		data[name] = convertJSON(value)
+	}
+	return data, nil
+}
+
+// convertJSON преобразует числа JSON (в том числе во вложенных объектах и массивах) в int64 или float64
+func convertJSON(value interface{}) interface{} {
+	switch value := value.(type) {
+	case json.Number:
+		if result, err := value.Int64(); err == nil {
+			return result
+		}
+		result, _ := value.Float64()
+		return result
+	case map[string]interface{}:
+		for key, item := range value {
+			value[key] = convertJSON(item)
+		}
+	case []interface{}:
+		for key, item := range value {
+			value[key] = convertJSON(item)
+		}
+	}
+	return value
+}
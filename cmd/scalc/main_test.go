@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scalc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	params := filepath.Join(dir, "params.json")
+	if err := ioutil.WriteFile(params, []byte(`{"a": 2, "b": 1.5, "c": "abc", "d": {"e": 4}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expr := filepath.Join(dir, "expr.sc")
+	if err := ioutil.WriteFile(expr, []byte("a @\n3 *\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, round := range []struct {
+		args   []string
+		stdin  string
+		code   int
+		stdout string
+		stderr string
+	}{
+		{[]string{"1 2 +", "'a\\sb 1.0"}, "", 0, "3\n\"a b\" 1.0\n", ""},
+		{[]string{"-p", "x=5", "-p", "s='7", "x @ 2 * s @"}, "", 0, "10 \"7\"\n", ""},
+		{[]string{"-params", params, "-p", "a=3", "a @ b @ c @ upper"}, "", 0, "3 1.5 \"ABC\"\n", ""},
+		{[]string{"-params", params, "-f", expr}, "", 0, "6\n", ""},
+		{[]string{"-params", params, "-infix", "d.e * a"}, "", 0, "8\n", ""},
+		{nil, "1 2\n+", 0, "3\n", ""},
+		{[]string{"1 0 /"}, "", 1, "", "error: division by zero at lexeme 2 (offset 4) \"/\": integer divide by zero\n  1 0 /\n      ^\n  stack: 1 0\n"},
+		{[]string{"-check", "1 'a +"}, "", 1, "", "error: type mismatch"},
+		{[]string{"-trace", "-p", "x=1", "x @ 2 +"}, "", 0, "3\n", "0:0\tx\tconstant\t[] -> [\"x\"]\n1:2\t@\toperation\t[\"x\"] -> [1]\n2:4\t2\tconstant\t[1] -> [1 2]\n3:6\t+\toperation\t[1 2] -> [3]\n"},
+		{[]string{"-infix", "-p", "price=3", "-p", "qty=2", "(price * qty) - 1"}, "", 0, "5\n", ""},
+		{[]string{"-infix", "1 +"}, "", 1, "", "unexpected end of expression\n  1 +\n     ^\n"},
+		{[]string{"-p", "x"}, "", 2, "", "must be name=value"},
+		{[]string{"-i"}, "1 2\n+\n\n1 0 /\n.define sq dup *\nsq\n.clear\n.quit\n1\n", 0,
+			"> 1 2\n> 3\n> > error: division by zero at lexeme 2 (offset 4) \"/\": integer divide by zero\n  1 0 /\n      ^\n  stack: 3 1 0\n> > 9\n> \n> ", ""},
+		{[]string{"-i"}, "1 2\n.debug + 3 *\nb *\nc\nn\n", 0, "> 1 2\n" +
+			">   at lexeme 0 (offset 0) \"+\" operation\n  + 3 *\n  ^\n  stack: 1 2\n" +
+			"debug>   at lexeme 0 (offset 0) \"+\" operation\n  + 3 *\n  ^\n  stack: 1 2\n" +
+			"debug>   at lexeme 2 (offset 4) \"*\" operation\n  + 3 *\n      ^\n  stack: 3 3\n" +
+			"debug> 9\n> \n", ""},
+	} {
+		stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+		code := run(round.args, strings.NewReader(round.stdin), stdout, stderr)
+		if code != round.code || stdout.String() != round.stdout || !strings.Contains(stderr.String(), round.stderr) {
+			t.Errorf("args %#v: code %d, stdout %#v, stderr %#v", round.args, code, stdout.String(), stderr.String())
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package scalc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Debugger определяет пошаговое выполнение выражения: выполнение приостанавливается перед каждой инструкцией,
+// позволяя просматривать и изменять стек и параметры выражения
+// Отладчик не безопасен для одновременного использования из нескольких горутин
+type Debugger struct {
+	calc      *Calculators
+	do        *does
+	pc        int             // адрес инструкции, перед выполнением которой приостановлено выполнение
+	result    []interface{}   // значения стека после успешного завершения выполнения
+	err       error           // ошибка выполнения выражения
+	finished  bool            // выполнение выражения завершено
+	lexemes   map[int]bool    // точки останова на порядковых номерах лексем
+	operators map[string]bool // точки останова на лексемах (именах операций)
+}
+
+// Debug начинает пошаговое выполнение выражения calc с копией набора параметров data в контексте ctx
+// Выполнение приостановлено перед первой инструкцией выражения
+// После завершения работы с отладчиком следует вызвать Debugger.Close
+func (calc *Calculators) Debug(ctx context.Context, data map[string]interface{}) *Debugger {
+	args := make(map[string]interface{}, len(data))
+	for name, value := range data {
+		args[name] = value
+	}
+	dbg := &Debugger{calc: calc, do: calc.acquire(args), lexemes: map[int]bool{}, operators: map[string]bool{}}
+	if dbg.do.done = ctx.Done(); dbg.do.done != nil {
+		dbg.do.ctx = ctx
+	}
+	dbg.safely(dbg.skip)
+	return dbg
+}
+
+// Close завершает пошаговое выполнение и освобождает ресурсы отладчика
+func (dbg *Debugger) Close() {
+	if dbg.do != nil {
+		dbg.do.release()
+		dbg.do = nil
+	}
+	dbg.finished = true
+}
+
+// Done возвращает признак завершения выполнения выражения (успешного или с ошибкой)
+func (dbg *Debugger) Done() bool {
+	return dbg.finished
+}
+
+// Result возвращает значения стека после успешного завершения выполнения выражения или ошибку выполнения
+func (dbg *Debugger) Result() ([]interface{}, error) {
+	if dbg.err != nil {
+		return nil, dbg.err
+	} else if dbg.result == nil {
+		return nil, errors.New("execution is not finished")
+	}
+	return dbg.result, nil
+}
+
+// Position возвращает шаг, перед которым приостановлено выполнение выражения
+// Возвращает false, если выполнение завершено
+func (dbg *Debugger) Position() (Step, bool) {
+	if dbg.finished {
+		return Step{Lexeme: -1, Offset: -1}, false
+	}
+	in := &dbg.calc.program[dbg.pc]
+	return Step{in.code.String(), in.lexeme, in.index, in.offset, dbg.Stack()}, true
+}
+
+// Stack возвращает копию стека выполнения
+func (dbg *Debugger) Stack() []interface{} {
+	if dbg.do == nil {
+		return nil
+	}
+	return append(make([]interface{}, 0, len(dbg.do.stack)), dbg.do.stack...)
+}
+
+// SetStack заменяет стек выполнения значениями stack
+// Возвращает ошибку, если выполнение завершено или какое-либо из значений имеет недопустимый тип
+func (dbg *Debugger) SetStack(stack []interface{}) error {
+	if dbg.finished {
+		return errors.New("execution is finished")
+	}
+	for _, value := range stack {
+		if !validKinds[kindOf(value)] {
+			return fmt.Errorf("stack value type %v is not valid", kindOf(value))
+		}
+	}
+	dbg.do.stack = append(dbg.do.stack[:0], stack...)
+	return nil
+}
+
+// Args возвращает копию набора параметров выражения
+func (dbg *Debugger) Args() map[string]interface{} {
+	result := map[string]interface{}{}
+	if dbg.do != nil {
+		for name, value := range dbg.do.args {
+			result[name] = value
+		}
+	}
+	return result
+}
+
+// SetArg устанавливает значение параметра выражения с именем name
+// Возвращает ошибку, если выполнение завершено
+func (dbg *Debugger) SetArg(name string, value interface{}) error {
+	if dbg.finished {
+		return errors.New("execution is finished")
+	}
+	dbg.do.args[name] = value
+	return nil
+}
+
+// BreakAt устанавливает точку останова на лексеме с порядковым номером lexeme (с нуля)
+// Отладчик выполняет оптимизированную программу: лексемы, вычисленные при разборе (например, 1 и 2 в 1 2 + ...),
+// не имеют инструкций, и точки останова на них не срабатывают. В этом случае возвращается false;
+// для остановки на каждой лексеме калькулятор создаётся в окружении с отключённой оптимизацией (SetOptimization)
+func (dbg *Debugger) BreakAt(lexeme int) bool {
+	dbg.lexemes[lexeme] = true
+	for _, in := range dbg.calc.program {
+		if in.index == lexeme {
+			return true
+		}
+	}
+	return false
+}
+
+// BreakOn устанавливает точку останова на всех лексемах operator (например, на операции с таким именем)
+func (dbg *Debugger) BreakOn(operator string) {
+	dbg.operators[operator] = true
+}
+
+// ClearBreaks удаляет все точки останова
+func (dbg *Debugger) ClearBreaks() {
+	dbg.lexemes = map[int]bool{}
+	dbg.operators = map[string]bool{}
+}
+
+// Step выполняет одну инструкцию выражения
+// Возвращает ошибку выполнения инструкции или ошибку, если выполнение уже завершено
+func (dbg *Debugger) Step() error {
+	if dbg.finished {
+		return dbg.stopped()
+	}
+	dbg.execute()
+	return dbg.err
+}
+
+// StepOver выполняет инструкцию выражения; если инструкция начинает ветвление, цикл или вызов слова -
+// выполняет их полностью. Выполнение приостанавливается раньше на точке останова
+func (dbg *Debugger) StepOver() error {
+	if dbg.finished {
+		return dbg.stopped()
+	}
+	switch dbg.calc.program[dbg.pc].code {
+	case opSwitch, opJumpFalse, opTimes, opEnter, opCall:
+	default:
+		dbg.execute()
+		return dbg.err
+	}
+	end, depth := blockEnd(dbg.calc.program, dbg.pc), len(dbg.do.returns)
+	for dbg.execute(); !dbg.finished && !(dbg.pc == end && len(dbg.do.returns) == depth); dbg.execute() {
+		if dbg.breaks() {
+			break
+		}
+	}
+	return dbg.err
+}
+
+// Continue выполняет выражение до следующей точки останова или до завершения
+func (dbg *Debugger) Continue() error {
+	if dbg.finished {
+		return dbg.stopped()
+	}
+	for dbg.execute(); !dbg.finished && !dbg.breaks(); dbg.execute() {
+	}
+	return dbg.err
+}
+
+// stopped возвращает ошибку выполнения или ошибку завершённого выполнения
+func (dbg *Debugger) stopped() error {
+	if dbg.err != nil {
+		return dbg.err
+	}
+	return errors.New("execution is finished")
+}
+
+// breaks проверяет наличие точки останова на текущей инструкции
+func (dbg *Debugger) breaks() bool {
+	in := &dbg.calc.program[dbg.pc]
+	return dbg.lexemes[in.index] || dbg.operators[in.lexeme]
+}
+
+// execute выполняет текущую инструкцию и следующие за ней служебные инструкции
+func (dbg *Debugger) execute() {
+	dbg.safely(func() {
+		dbg.pc = dbg.do.execute(dbg.calc.program, dbg.pc, 0)
+		dbg.skip()
+	})
+}
+
+// safely выполняет инструкции функцией fn и преобразует панику выполнения в ошибку, завершающую выполнение
+func (dbg *Debugger) safely(fn func()) {
+	defer func() {
+		if temp := recover(); temp != nil {
+			dbg.err = dbg.do.fail(temp)
+			dbg.finished = true
+		}
+	}()
+	fn()
+}
+
+// skip выполняет служебные инструкции (возврат из слова, завершение программы), не связанные с лексемами,
+// до следующей инструкции, связанной с лексемой, или до завершения программы
+func (dbg *Debugger) skip() {
+	program := dbg.calc.program
+	for dbg.pc < len(program) && program[dbg.pc].index < 0 {
+		dbg.pc = dbg.do.execute(program, dbg.pc, 0)
+	}
+	if dbg.pc >= len(program) {
+		dbg.finished = true
+		dbg.result = append(make([]interface{}, 0, len(dbg.do.stack)), dbg.do.stack...)
+	}
+}
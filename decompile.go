@@ -0,0 +1,429 @@
+package scalc
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// identifierPattern содержит шаблон имён параметров, записываемых в инфиксном выражении без кавычек
+var identifierPattern = regexp.MustCompile(`^[\pL_][\pL\pN_]*(?:\.[\pL_][\pL\pN_]*)*$`)
+
+// infixSymbols содержит знаки бинарных операций инфиксного выражения, отличающиеся от имён операций окружения
+var infixSymbols = map[string]string{"=": "==", "#": "!="}
+
+// infixNames содержит знаки префиксных унарных операций инфиксного выражения
+var infixNames = map[string]string{"--": "-", "!": "!", "not": "not ", "~": "~"}
+
+// infixKeywords содержит идентификаторы, которые не могут быть именами параметров в инфиксном выражении
+var infixKeywords = map[string]bool{"and": true, "or": true, "xor": true, "not": true, "true": true, "false": true}
+
+// infixAtom содержит приоритет константы, параметра, вызова функции и выражения в скобках
+const infixAtom = 10
+
+// maxProbe содержит максимальное количество операндов операции при определении её стекового эффекта
+const maxProbe = 16
+
+// terms определяет элемент инфиксного выражения
+type terms struct {
+	text   string // запись элемента
+	prec   int    // приоритет операции элемента (infixAtom для констант, параметров и вызовов функций)
+	simple bool   // элемент может повторяться без привязки к переменной (константа, параметр, переменная)
+}
+
+// decompilers определяет преобразование дерева разбора постфиксного выражения в инфиксное
+type decompilers struct {
+	stack []terms  // модель стека, элементы которого являются инфиксными выражениями
+	lines []string // операторы, предшествующие результату (привязки let, циклы, выходные параметры)
+	low   int      // наименьшая глубина стека, достигнутая при преобразовании
+	temps *int     // счётчик временных переменных
+}
+
+// Decompile преобразует постфиксное выражение expr в инфиксную запись с использованием окружения по умолчанию
+func Decompile(expr string) (string, error) {
+	return defaultEnvironment.Decompile(expr)
+}
+
+// Decompile преобразует исходное выражение калькулятора в инфиксную запись (см. Environment.Decompile)
+// Операции выражения определяются по окружению по умолчанию; для калькуляторов, созданных в другом окружении,
+// следует использовать Environment.Decompile с текстом калькулятора (Calculators.MarshalText)
+func (calc *Calculators) Decompile() (string, error) {
+	return defaultEnvironment.Decompile(calc.source)
+}
+
+// Decompile преобразует постфиксное выражение expr в инфиксную запись для отображения,
+// например price @ qty @ * discount @ - в price * qty - discount
+// Скобки расставляются только там, где они необходимы; количество операндов операций определяется по их стековому эффекту
+// Ветвление по индексу записывается как case index when 0 then a when 1 then b else c end, условное ветвление - как if(cond, a, b)
+// Значения, используемые повторно (dup, over), и локальные переменные привязываются конструкцией let $name = value,
+// циклы записываются как repeat n { ... } и while cond { ... } с присваиванием изменяемых переменных;
+// операторы отделяются от результата точкой с запятой, несколько результатов - запятой
+func (env *Environment) Decompile(expr string) (string, error) {
+	tree, err := env.parse(expr)
+	if err != nil {
+		return "", err
+	}
+	dec := decompilers{temps: new(int)}
+	env.lock.RLock()
+	defer env.lock.RUnlock()
+	if err := dec.run(tree); err != nil {
+		return "", err
+	}
+	return dec.String(), nil
+}
+
+// String возвращает операторы и результаты инфиксного выражения
+func (dec *decompilers) String() string {
+	items := make([]string, len(dec.stack))
+	for key, term := range dec.stack {
+		items[key] = term.text
+	}
+	if len(dec.lines) == 0 {
+		return strings.Join(items, ", ")
+	} else if len(items) == 0 {
+		return strings.Join(dec.lines, "; ")
+	}
+	return strings.Join(dec.lines, "; ") + "; " + strings.Join(items, ", ")
+}
+
+// nested создаёт преобразование варианта ветвления или тела цикла со стеком stack
+func (dec *decompilers) nested(stack []terms) *decompilers {
+	return &decompilers{stack: append([]terms(nil), stack...), low: len(stack), temps: dec.temps}
+}
+
+// push помещает элементы в модель стека
+func (dec *decompilers) push(items ...terms) {
+	dec.stack = append(dec.stack, items...)
+}
+
+// pop извлекает из модели стека count элементов
+func (dec *decompilers) pop(count int) ([]terms, *Error) {
+	last := len(dec.stack) - count
+	if last < 0 {
+		return nil, failure(ErrStackUnderflow, fmt.Errorf("%d values required, %d available", count, len(dec.stack)))
+	}
+	if last < dec.low {
+		dec.low = last
+	}
+	result := append([]terms(nil), dec.stack[last:]...)
+	dec.stack = dec.stack[:last]
+	return result, nil
+}
+
+// temp возвращает новую временную переменную
+func (dec *decompilers) temp() terms {
+	*dec.temps++
+	return terms{"$" + strconv.Itoa(*dec.temps), infixAtom, true}
+}
+
+// bind привязывает элемент стека с номером key к временной переменной, если он не является простым
+func (dec *decompilers) bind(key int) {
+	if !dec.stack[key].simple {
+		name := dec.temp()
+		dec.lines = append(dec.lines, "let "+name.text+" = "+dec.stack[key].text)
+		dec.stack[key] = name
+	}
+}
+
+// run преобразует последовательность элементов дерева разбора
+func (dec *decompilers) run(tree []nodes) *Error {
+	for _, node := range tree {
+		var err *Error
+		switch node.kind {
+		case nodeConstant:
+			dec.push(constantTerm(node.value))
+		case nodeOperation:
+			err = dec.operation(node)
+		case nodeSelect, nodeCondition:
+			err = dec.branches(node)
+		case nodeTimes, nodeWhile:
+			err = dec.loop(node)
+		case nodeCall:
+			err = dec.run(node.word.body)
+		case nodeStore:
+			err = dec.store("$"+node.value.(string), "let ")
+		case nodeOutput:
+			err = dec.store("=>"+node.value.(string), "")
+		case nodeFetch:
+			dec.push(terms{"$" + node.value.(string), infixAtom, true})
+		}
+		if err != nil {
+			return err.at(node.positions)
+		}
+	}
+	return nil
+}
+
+// store записывает оператор сохранения значения из вершины стека в локальную переменную или выходной параметр name
+// Элементы стека, использующие локальную переменную, предварительно привязываются к временным переменным
+func (dec *decompilers) store(name, prefix string) *Error {
+	items, err := dec.pop(1)
+	if err != nil {
+		return err
+	}
+	for key, item := range dec.stack {
+		if prefix != "" && strings.Contains(item.text, name) {
+			dec.bind(key)
+		}
+	}
+	dec.lines = append(dec.lines, prefix+name+" = "+items[0].text)
+	return nil
+}
+
+// operation преобразует операцию окружения
+func (dec *decompilers) operation(node nodes) *Error {
+	switch node.op.builtin {
+	case "dup", "over":
+		count := 1
+		if node.op.builtin == "over" {
+			count = 2
+		}
+		items, err := dec.pop(count)
+		if err != nil {
+			return err
+		}
+		dec.push(items...)
+		dec.bind(len(dec.stack) - count)
+		dec.push(dec.stack[len(dec.stack)-count])
+		return nil
+	case "drop":
+		_, err := dec.pop(1)
+		return err
+	case "swap":
+		items, err := dec.pop(2)
+		if err == nil {
+			dec.push(items[1], items[0])
+		}
+		return err
+	case "@":
+		items, err := dec.pop(1)
+		if err != nil {
+			return err
+		}
+		if name, err := strconv.Unquote(items[0].text); err == nil && identifierPattern.MatchString(name) && !infixKeywords[name] {
+			dec.push(terms{name, infixAtom, true})
+		} else {
+			dec.push(terms{"@(" + items[0].text + ")", infixAtom, false})
+		}
+		return nil
+	}
+
+	in, out, ok := effect(node.op)
+	if !ok {
+		return failure(ErrStackEffect, fmt.Errorf("operation %#v has no static stack effect", node.lexeme))
+	}
+	args, err := dec.pop(in)
+	if err != nil {
+		return err
+	}
+	symbol := node.lexeme
+	if temp, exists := infixSymbols[symbol]; exists {
+		symbol = temp
+	}
+	if binary, exists := infixBinary[symbol]; exists && in == 2 && out == 1 {
+		left, right := args[0], args[1]
+		if left.prec < binary.precedence || left.prec == binary.precedence && binary.right {
+			left = parens(left)
+		}
+		if right.prec < binary.precedence || right.prec == binary.precedence && !binary.right {
+			right = parens(right)
+		}
+		dec.push(terms{left.text + " " + symbol + " " + right.text, binary.precedence, false})
+		return nil
+	} else if prefix, exists := infixNames[node.lexeme]; exists && in == 1 && out == 1 {
+		operand := args[0]
+		if operand.prec < infixPrefix {
+			operand = parens(operand)
+		}
+		dec.push(terms{prefix + operand.text, infixPrefix, false})
+		return nil
+	}
+
+	texts := make([]string, len(args))
+	order, reordered := infixArguments[node.lexeme]
+	for key, arg := range args {
+		if reordered && len(order) == len(args) {
+			texts[order[key]] = arg.text
+		} else {
+			texts[key] = arg.text
+		}
+	}
+	call := node.lexeme + "(" + strings.Join(texts, ", ") + ")"
+	switch out {
+	case 0:
+		dec.lines = append(dec.lines, call)
+	case 1:
+		dec.push(terms{call, infixAtom, false})
+	default:
+		names := make([]string, out)
+		for key := range names {
+			name := dec.temp()
+			names[key] = name.text
+			dec.push(name)
+		}
+		dec.lines = append(dec.lines, "let "+strings.Join(names, ", ")+" = "+call)
+	}
+	return nil
+}
+
+// branches преобразует ветвление по индексу в выражение case и условное ветвление в выражение if
+// Значения стека, не изменяемые ни одним из вариантов, остаются в стеке; остальные заменяются выражениями ветвления
+func (dec *decompilers) branches(node nodes) *Error {
+	items, err := dec.pop(1)
+	if err != nil {
+		return err
+	}
+	branches := node.branches
+	if node.kind == nodeCondition && len(branches) == 1 {
+		branches = [][]nodes{branches[0], nil}
+	}
+	results := make([]*decompilers, len(branches))
+	base := len(dec.stack)
+	for key, branch := range branches {
+		results[key] = dec.nested(dec.stack)
+		if err := results[key].run(branch); err != nil {
+			return err
+		}
+		if results[key].low < base {
+			base = results[key].low
+		}
+	}
+	count := len(results[0].stack) - base
+	for _, result := range results {
+		if len(result.stack)-base != count {
+			return failure(ErrStackEffect, errors.New("branches have different stack effects"))
+		}
+	}
+	if base < dec.low {
+		dec.low = base
+	}
+	dec.stack = dec.stack[:base]
+	for pos := 0; pos < count; pos++ {
+		values := make([]string, len(results))
+		for key, result := range results {
+			values[key] = result.value(base + pos)
+		}
+		if node.kind == nodeCondition {
+			dec.push(terms{"if(" + items[0].text + ", " + values[0] + ", " + values[1] + ")", infixAtom, false})
+			continue
+		}
+		text := strings.Builder{}
+		text.WriteString("case " + items[0].text)
+		for key, value := range values {
+			if key == len(values)-1 && node.fallback {
+				text.WriteString(" else " + value)
+			} else {
+				text.WriteString(" when " + strconv.Itoa(key) + " then " + value)
+			}
+		}
+		text.WriteString(" end")
+		dec.push(terms{text.String(), infixAtom, false})
+	}
+	return nil
+}
+
+// value возвращает запись элемента стека с номером key с предшествующими ему операторами варианта ветвления
+func (dec *decompilers) value(key int) string {
+	if len(dec.lines) == 0 {
+		return dec.stack[key].text
+	}
+	return "{ " + strings.Join(dec.lines, "; ") + "; " + dec.stack[key].text + " }"
+}
+
+// loop преобразует цикл: значения стека, изменяемые телом цикла, привязываются к временным переменным,
+// которым в конце каждого повторения присваиваются новые значения
+func (dec *decompilers) loop(node nodes) *Error {
+	var head string
+	cond, body := node.branches[0], []nodes(nil)
+	if node.kind == nodeTimes {
+		items, err := dec.pop(1)
+		if err != nil {
+			return err
+		}
+		head, cond, body = "repeat "+items[0].text, nil, node.branches[0]
+	} else {
+		body = node.branches[1]
+	}
+
+	probe := dec.nested(dec.stack)
+	probe.temps = new(int)
+	if err := probe.run(append(append([]nodes(nil), cond...), body...)); err != nil {
+		return err
+	}
+	base := probe.low
+	if base < dec.low {
+		dec.low = base
+	}
+	for key := base; key < len(dec.stack); key++ {
+		name := dec.temp()
+		dec.lines = append(dec.lines, "let "+name.text+" = "+dec.stack[key].text)
+		dec.stack[key] = name
+	}
+
+	if cond != nil {
+		check := dec.nested(dec.stack)
+		if err := check.run(cond); err != nil {
+			return err
+		} else if len(check.stack) != len(dec.stack)+1 {
+			return failure(ErrStackEffect, errors.New("loop condition must push exactly one value"))
+		}
+		head = "while " + check.value(len(check.stack)-1)
+	}
+	inner := dec.nested(dec.stack)
+	if err := inner.run(body); err != nil {
+		return err
+	} else if len(inner.stack) != len(dec.stack) {
+		return failure(ErrStackEffect, errors.New("loop body changes stack depth"))
+	}
+	lines := inner.lines
+	names, values := []string{}, []string{}
+	for key := base; key < len(dec.stack); key++ {
+		if inner.stack[key].text != dec.stack[key].text {
+			names = append(names, dec.stack[key].text)
+			values = append(values, inner.stack[key].text)
+		}
+	}
+	if len(names) > 0 {
+		lines = append(lines, strings.Join(names, ", ")+" = "+strings.Join(values, ", "))
+	}
+	dec.lines = append(dec.lines, head+" { "+strings.Join(lines, "; ")+" }")
+	return nil
+}
+
+// effect определяет стековый эффект операции: количество снимаемых с вершины стека и помещаемых в стек значений
+// Эффект моделируется статической проверкой операции над значениями неопределённого типа
+func effect(op Operation) (in, out int, ok bool) {
+	if op.check == nil {
+		return 0, 0, false
+	}
+	for in = op.arity; in <= maxProbe; in++ {
+		chk := checks{make([]reflect.Kind, in)}
+		for key := range chk.stack {
+			chk.stack[key] = Any
+		}
+		err := op.check(&chk)
+		if err == nil {
+			return in, len(chk.stack), true
+		} else if err.Category != ErrStackUnderflow {
+			return 0, 0, false
+		}
+	}
+	return 0, 0, false
+}
+
+// constantTerm возвращает элемент инфиксного выражения для значения константы
+func constantTerm(value interface{}) terms {
+	text := literal(value)
+	if strings.HasPrefix(text, "-") {
+		return terms{text, infixPrefix, true}
+	}
+	return terms{text, infixAtom, true}
+}
+
+// parens заключает элемент инфиксного выражения в скобки
+func parens(term terms) terms {
+	return terms{"(" + term.text + ")", infixAtom, term.simple}
+}
@@ -0,0 +1,195 @@
+package scalc
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// DefaultLoopLimit содержит допустимое по умолчанию количество повторений цикла
+const DefaultLoopLimit = 10000
+
+// Environment определяет окружение калькулятора: собственный набор операций, используемый при разборе выражений
+// Методы окружения безопасны для одновременного использования из нескольких горутин
+// Окружение создаётся функцией NewEnvironment или методом Clone: нулевое значение Environment
+// не содержит операций и допустимого количества повторений цикла и не может использоваться
+type Environment struct {
+	lock    sync.RWMutex
+	actions map[string]Operation // набор операций окружения
+	removed map[string]bool      // имена удалённых операций
+	loops   int                  // допустимое количество повторений цикла
+	limits  *Limits              // ограничения ресурсов выполнения выражения (nil, если ограничения не заданы)
+	plain   bool                 // оптимизация выражений отключена
+}
+
+// defaultEnvironment содержит окружение по умолчанию, используемое функциями New, NewChecked и Register
+var defaultEnvironment = &Environment{actions: actions, removed: map[string]bool{}, loops: DefaultLoopLimit}
+
+// NewEnvironment создаёт окружение с копией набора операций окружения по умолчанию
+// (встроенные операции и операции, добавленные функцией Register)
+func NewEnvironment() *Environment {
+	return defaultEnvironment.Clone()
+}
+
+// Clone создаёт копию окружения
+func (env *Environment) Clone() *Environment {
+	env.lock.RLock()
+	defer env.lock.RUnlock()
+	result := &Environment{
+		actions: make(map[string]Operation, len(env.actions)),
+		removed: make(map[string]bool, len(env.removed)),
+		loops:   env.loops,
+		limits:  env.limits,
+		plain:   env.plain,
+	}
+	for name, op := range env.actions {
+		result.actions[name] = op
+	}
+	for name := range env.removed {
+		result.removed[name] = true
+	}
+	return result
+}
+
+// Register добавляет операцию op с именем name в набор операций окружения
+// Возвращает ошибку, если имя недопустимо или операция с таким именем уже существует
+func (env *Environment) Register(name string, op Operation) error {
+	if err := validName(name); err != nil {
+		return err
+	}
+	env.lock.Lock()
+	defer env.lock.Unlock()
+	if _, exists := env.actions[name]; exists {
+		return fmt.Errorf("operation %#v already exists", name)
+	}
+	env.actions[name] = op
+	delete(env.removed, name)
+	return nil
+}
+
+// Override заменяет существующую операцию с именем name на операцию op
+// Возвращает ошибку, если операция с таким именем не существует
+func (env *Environment) Override(name string, op Operation) error {
+	env.lock.Lock()
+	defer env.lock.Unlock()
+	if _, exists := env.actions[name]; !exists {
+		return fmt.Errorf("operation %#v does not exist", name)
+	}
+	env.actions[name] = op
+	return nil
+}
+
+// Remove удаляет операции с именами names из набора операций окружения
+// Имена удалённых операций не могут использоваться в выражениях (в том числе как строковые константы без кавычки)
+// Возвращает ошибку, если какая-либо из операций не существует; в этом случае набор операций не изменяется
+func (env *Environment) Remove(names ...string) error {
+	env.lock.Lock()
+	defer env.lock.Unlock()
+	for _, name := range names {
+		if _, exists := env.actions[name]; !exists {
+			return fmt.Errorf("operation %#v does not exist", name)
+		}
+	}
+	for _, name := range names {
+		delete(env.actions, name)
+		env.removed[name] = true
+	}
+	return nil
+}
+
+// Define добавляет в набор операций окружения пользовательское слово с именем name и телом body,
+// доступное всем калькуляторам, создаваемым в окружении. Тело слова разбирается и компилируется однократно
+// Возвращает ошибку, если тело слова содержит ошибку разбора, имя недопустимо или операция с таким именем уже существует
+func (env *Environment) Define(name, body string) error {
+	if err := validName(name); err != nil {
+		return err
+	}
+	tree, err := env.parse(body)
+	if err != nil {
+		return err
+	}
+	env.lock.RLock()
+	plain, limits := env.plain, env.limits
+	env.lock.RUnlock()
+	if !plain {
+		tree = optimize(tree, limits)
+	}
+	return env.Register(name, operatorWord(&words{name: name, body: tree, program: compile(tree)}))
+}
+
+// SetLoopLimit устанавливает допустимое количество повторений каждого цикла для калькуляторов,
+// создаваемых в окружении. При превышении количества повторений выполнение завершается ошибкой ErrLoopLimit
+func (env *Environment) SetLoopLimit(limit int) error {
+	if limit < 1 {
+		return errors.New("loop limit must be positive")
+	}
+	env.lock.Lock()
+	defer env.lock.Unlock()
+	env.loops = limit
+	return nil
+}
+
+// SetLimits устанавливает ограничения ресурсов выполнения выражения для калькуляторов, создаваемых в окружении
+// Нулевое значение Limits снимает все ограничения
+func (env *Environment) SetLimits(limits Limits) error {
+	if err := limits.valid(); err != nil {
+		return err
+	}
+	env.lock.Lock()
+	defer env.lock.Unlock()
+	if limits == (Limits{}) {
+		env.limits = nil
+	} else {
+		env.limits = &limits
+	}
+	return nil
+}
+
+// SetOptimization включает или отключает оптимизацию выражений калькуляторов, создаваемых в окружении
+// (по умолчанию включена): вычисление чистых операций над константами при разборе, устранение пар dup drop
+// и swap swap, замену ветвлений с константным индексом или условием выбранным вариантом
+func (env *Environment) SetOptimization(enabled bool) {
+	env.lock.Lock()
+	defer env.lock.Unlock()
+	env.plain = !enabled
+}
+
+// New получает на вход строку, содержащую выражение, и возвращает экземпляр калькулятора,
+// вычисляющего это выражение с использованием набора операций окружения
+func (env *Environment) New(expr string) (*Calculators, error) {
+	tree, err := env.parse(expr)
+	if err != nil {
+		return nil, err
+	}
+	return env.calculator(tree), nil
+}
+
+// NewChecked работает аналогично New, но дополнительно выполняет статическую проверку выражения
+func (env *Environment) NewChecked(expr string) (*Calculators, error) {
+	tree, err := env.parse(expr)
+	if err != nil {
+		return nil, err
+	}
+	if err = check(tree); err != nil {
+		return nil, err
+	}
+	return env.calculator(tree), nil
+}
+
+// calculator создаёт калькулятор, вычисляющий выражение с деревом разбора tree
+// Исходное выражение калькулятора сохраняется в каноническом виде (см. Environment.Format)
+func (env *Environment) calculator(tree []nodes) *Calculators {
+	env.lock.RLock()
+	defer env.lock.RUnlock()
+	source := env.format(tree)
+	if !env.plain {
+		tree = optimize(tree, env.limits)
+	}
+	return &Calculators{compile(tree), env.loops, env.limits, source}
+}
+
+// Register добавляет операцию op с именем name в набор операций окружения по умолчанию
+// Возвращает ошибку, если имя недопустимо или операция с таким именем уже существует
+func Register(name string, op Operation) error {
+	return defaultEnvironment.Register(name, op)
+}
@@ -0,0 +1,99 @@
+package scalc
+
+import "fmt"
+
+// Categories определяет категорию ошибки калькулятора
+type Categories int
+
+const (
+	ErrRuntime        Categories = iota // прочие ошибки выполнения выражения
+	ErrSyntax                           // синтаксическая ошибка выражения
+	ErrStackUnderflow                   // недостаточно значений в стеке
+	ErrStackEffect                      // различный стековый эффект вариантов ветвления
+	ErrTypeMismatch                     // недопустимый тип значения
+	ErrDivisionByZero                   // целочисленное деление на ноль
+	ErrConversion                       // ошибка преобразования значения
+	ErrOperand                          // недопустимое значение операнда
+	ErrParameter                        // недопустимое значение параметра выражения
+	ErrResult                           // недопустимый результат выполнения выражения
+	ErrLoopLimit                        // превышено допустимое количество повторений цикла
+	ErrCanceled                         // выполнение прервано отменой или истечением срока контекста
+	ErrLimit                            // превышено ограничение ресурсов выполнения выражения
+	ErrNotFound                         // параметр выражения не найден в наборе параметров
+)
+
+// categoryNames содержит названия категорий ошибок
+var categoryNames = map[Categories]string{
+	ErrRuntime:        "runtime error",
+	ErrSyntax:         "syntax error",
+	ErrStackUnderflow: "stack underflow",
+	ErrStackEffect:    "stack effect mismatch",
+	ErrTypeMismatch:   "type mismatch",
+	ErrDivisionByZero: "division by zero",
+	ErrConversion:     "conversion error",
+	ErrOperand:        "invalid operand",
+	ErrParameter:      "invalid parameter",
+	ErrResult:         "invalid result",
+	ErrLoopLimit:      "loop limit exceeded",
+	ErrCanceled:       "execution canceled",
+	ErrLimit:          "resource limit exceeded",
+	ErrNotFound:       "parameter not found",
+}
+
+// String возвращает название категории ошибки
+func (category Categories) String() string {
+	if name, exists := categoryNames[category]; exists {
+		return name
+	}
+	return fmt.Sprintf("category %d", int(category))
+}
+
+// Error определяет ошибку, возвращаемую при разборе и выполнении выражения
+type Error struct {
+	Category Categories    // категория ошибки
+	Lexeme   int           // порядковый номер лексемы в выражении (с нуля) или -1, если ошибка не связана с лексемой
+	Offset   int           // смещение лексемы в выражении в байтах или -1, если ошибка не связана с лексемой
+	Operator string        // лексема (имя операции), при разборе или выполнении которой произошла ошибка
+	Stack    []interface{} // снимок стека в момент ошибки (только для ошибок выполнения)
+	Err      error         // исходная ошибка
+}
+
+// Error возвращает текстовое описание ошибки
+func (err *Error) Error() string {
+	if err.Lexeme < 0 {
+		return fmt.Sprintf("%v: %v", err.Category, err.Err)
+	}
+	return fmt.Sprintf("%v at lexeme %d (offset %d) %#v: %v", err.Category, err.Lexeme, err.Offset, err.Operator, err.Err)
+}
+
+// Unwrap возвращает исходную ошибку
+func (err *Error) Unwrap() error {
+	return err.Err
+}
+
+// failure создаёт ошибку заданной категории, не связанную с лексемой
+func failure(category Categories, err error) *Error {
+	return &Error{Category: category, Lexeme: -1, Offset: -1, Err: err}
+}
+
+// at привязывает ошибку к лексеме, если она ещё не была привязана
+func (err *Error) at(pos positions) *Error {
+	if err.Lexeme < 0 {
+		err.Lexeme = pos.index
+		err.Offset = pos.offset
+		err.Operator = pos.lexeme
+	}
+	return err
+}
+
+// recovered преобразует значение, полученное от recover, в ошибку калькулятора
+func recovered(temp interface{}) *Error {
+	switch temp := temp.(type) {
+	case *Error:
+		return temp
+	case error:
+		return failure(ErrRuntime, temp)
+	default:
+		return failure(ErrRuntime, fmt.Errorf("%v", temp))
+	}
+}
@@ -0,0 +1,261 @@
+package scalc
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// opcodeNames содержит названия кодов инструкций для дизассемблера
+var opcodeNames = [...]string{
+	opOperation: "operation",
+	opConstant:  "constant",
+	opJump:      "jump",
+	opJumpFalse: "jumpFalse",
+	opSwitch:    "switch",
+	opTimes:     "times",
+	opNext:      "next",
+	opEnter:     "enter",
+	opWhile:     "while",
+	opCall:      "call",
+	opReturn:    "return",
+	opStore:     "store",
+	opFetch:     "fetch",
+	opOutput:    "output",
+}
+
+// String возвращает название кода инструкции
+func (code opcodes) String() string {
+	if int(code) < len(opcodeNames) {
+		return opcodeNames[code]
+	}
+	return fmt.Sprintf("opcode %d", int(code))
+}
+
+// Format возвращает выражение expr в каноническом виде с использованием окружения по умолчанию
+func Format(expr string) (string, error) {
+	return defaultEnvironment.Format(expr)
+}
+
+// Format возвращает выражение expr в каноническом виде: лексемы разделены одним пробелом,
+// строковые константы записаны без кавычки, если это возможно, и с кавычкой и экранированием в остальных случаях,
+// числа записаны в десятичной форме (числа с плавающей точкой всегда содержат точку или экспоненту),
+// сохранение локальной переменной записано в форме !name
+// Эквивалентные выражения имеют одинаковый канонический вид
+func (env *Environment) Format(expr string) (string, error) {
+	tree, err := env.parse(expr)
+	if err != nil {
+		return "", err
+	}
+	env.lock.RLock()
+	defer env.lock.RUnlock()
+	return env.format(tree), nil
+}
+
+// format возвращает канонический вид выражения с деревом разбора tree
+// Вызывающий должен удерживать блокировку окружения
+func (env *Environment) format(tree []nodes) string {
+	if len(tree) == 1 && tree[0].kind == nodeConstant && tree[0].value == "" && tree[0].lexeme == "" {
+		return ""
+	}
+	names := map[string]bool{}
+	for _, node := range tree {
+		if node.kind == nodeDefinition {
+			names[node.word.name] = true
+		}
+	}
+	lexemes := make([]string, 0, len(tree))
+	env.lexemes(tree, names, &lexemes)
+	return strings.Join(lexemes, " ")
+}
+
+// lexemes добавляет в result канонические лексемы элементов дерева разбора
+func (env *Environment) lexemes(tree []nodes, names map[string]bool, result *[]string) {
+	for _, node := range tree {
+		switch node.kind {
+		case nodeConstant:
+			*result = append(*result, env.literal(node.value, names))
+		case nodeOperation, nodeCall:
+			*result = append(*result, node.lexeme)
+		case nodeSelect, nodeCondition, nodeTimes, nodeWhile:
+			switch node.kind {
+			case nodeCondition:
+				*result = append(*result, "?")
+			case nodeTimes:
+				*result = append(*result, "times")
+			case nodeWhile:
+				*result = append(*result, "while")
+			}
+			*result = append(*result, "[")
+			for key, branch := range node.branches {
+				if key == len(node.branches)-1 && node.fallback {
+					*result = append(*result, "else")
+				} else if key > 0 {
+					*result = append(*result, ";")
+				}
+				env.lexemes(branch, names, result)
+			}
+			*result = append(*result, "]")
+		case nodeDefinition:
+			*result = append(*result, ":", node.word.name)
+			env.lexemes(node.word.body, names, result)
+			*result = append(*result, ";")
+		case nodeStore:
+			*result = append(*result, "!"+node.value.(string))
+		case nodeFetch:
+			*result = append(*result, "$"+node.value.(string))
+		case nodeOutput:
+			*result = append(*result, "=>"+node.value.(string))
+		}
+	}
+}
+
+// literal возвращает каноническую запись значения константы в выражении
+func (env *Environment) literal(value interface{}, names map[string]bool) string {
+	if str, ok := value.(string); ok {
+		if env.bare(str, names) {
+			return str
+		}
+		return "'" + escapeString(str)
+	}
+	return literal(value)
+}
+
+// literal возвращает запись значения константы (строки записываются в кавычках Go)
+// Числа с плавающей точкой всегда содержат точку или экспоненту, чтобы отличаться от целых
+func literal(value interface{}) string {
+	switch value := value.(type) {
+	case int64:
+		return strconv.FormatInt(value, 10)
+	case float64:
+		result := strconv.FormatFloat(value, 'g', -1, 64)
+		if !math.IsInf(value, 0) && !math.IsNaN(value) && !strings.ContainsAny(result, ".e") {
+			result += ".0"
+		}
+		return result
+	case bool:
+		return strconv.FormatBool(value)
+	case string:
+		return strconv.Quote(value)
+	}
+	return fmt.Sprint(value)
+}
+
+// FormatValues возвращает значения стека, разделённые пробелами: числа и логические значения - в виде констант
+// выражения, строки - в кавычках Go (для вывода результатов и снимков стека)
+func FormatValues(values []interface{}) string {
+	items := make([]string, len(values))
+	for key, value := range values {
+		items[key] = literal(value)
+	}
+	return strings.Join(items, " ")
+}
+
+// FormatConstants возвращает значения стека в виде констант выражения, разделённых пробелами:
+// выражение из этих констант помещает в стек те же значения (строки записываются с кавычкой и экранированием)
+func FormatConstants(values []interface{}) string {
+	items := make([]string, len(values))
+	for key, value := range values {
+		if str, ok := value.(string); ok {
+			items[key] = "'" + escapeString(str)
+		} else {
+			items[key] = literal(value)
+		}
+	}
+	return strings.Join(items, " ")
+}
+
+// bare проверяет, что строковая константа может быть записана без кавычки и экранирования
+func (env *Environment) bare(str string, names map[string]bool) bool {
+	if str == "" || str[0] == '\'' || strings.ContainsRune(str, '\\') || strings.IndexFunc(str, unicode.IsSpace) >= 0 {
+		return false
+	} else if _, err := strconv.ParseFloat(str, 64); err == nil {
+		return false
+	} else if _, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return false
+	} else if name, _ := localName(str); name != "" {
+		return false
+	} else if _, exists := env.actions[str]; exists {
+		return false
+	}
+	return !reserved[str] && !env.removed[str] && !names[str]
+}
+
+// escapeString экранирует в строке специальные символы (обратная операция для convertString)
+func escapeString(str string) string {
+	return strings.NewReplacer("\\", "\\\\", " ", "\\s", "\n", "\\n", "\t", "\\t").Replace(str)
+}
+
+// Disassemble возвращает листинг программы калькулятора: по одной инструкции в строке
+// с адресом, кодом инструкции, операндами (константы - с типом значения, переходы - с адресами назначения)
+// и исходной лексемой. Варианты ветвлений и тела циклов выделяются отступом, тела пользовательских слов - меткой
+func (calc *Calculators) Disassemble() string {
+	program := calc.program
+	depth := make([]int, len(program))
+	entries := map[int]string{}
+	indent := func(from, to int) {
+		for key := from; key < to && key < len(program); key++ {
+			depth[key]++
+		}
+	}
+	for pc, in := range program {
+		switch in.code {
+		case opSwitch, opJumpFalse:
+			indent(pc+1, blockEnd(program, pc))
+		case opTimes:
+			indent(pc+1, blockEnd(program, pc)-1)
+		case opWhile:
+			if back := pc + in.jump; back > pc {
+				indent(back+1+program[back].jump, pc)
+				indent(pc+1, back)
+			}
+		case opCall:
+			entries[pc+1+in.jump] = in.lexeme
+		}
+	}
+
+	builder := strings.Builder{}
+	width := len(strconv.Itoa(len(program)))
+	for pc, in := range program {
+		if name, exists := entries[pc]; exists {
+			fmt.Fprintf(&builder, "%s:\n", name)
+		}
+		line := strings.Builder{}
+		fmt.Fprintf(&line, "%*d  %s%-9s", width, pc, strings.Repeat("  ", depth[pc]), in.code)
+		target := func(jump int) string { return strconv.Itoa(pc + 1 + jump) }
+		switch in.code {
+		case opOperation:
+			fmt.Fprintf(&line, " %s", in.lexeme)
+		case opConstant:
+			fmt.Fprintf(&line, " %v %s", kindOf(in.value), literal(in.value))
+		case opStore, opFetch, opOutput:
+			fmt.Fprintf(&line, " %s", in.value)
+		case opSwitch:
+			branches := make([]string, len(in.table)-1)
+			for key, jump := range in.table[:len(in.table)-1] {
+				branches[key] = target(jump)
+			}
+			if in.fallback {
+				branches[len(branches)-1] = "else " + branches[len(branches)-1]
+			}
+			fmt.Fprintf(&line, " -> [ %s ] end %s", strings.Join(branches, " ; "), target(in.table[len(in.table)-1]))
+		case opJump, opJumpFalse, opTimes, opNext, opWhile:
+			fmt.Fprintf(&line, " -> %s", target(in.jump))
+		case opCall:
+			fmt.Fprintf(&line, " %s -> %s", in.lexeme, target(in.jump))
+		}
+		builder.WriteString(strings.TrimRight(line.String(), " "))
+		if in.index >= 0 {
+			fmt.Fprintf(&builder, "\t; %d:%d %s", in.index, in.offset, in.lexeme)
+		}
+		builder.WriteString("\n")
+	}
+	return builder.String()
+}
+
+// String возвращает листинг программы калькулятора (см. Disassemble)
+func (calc *Calculators) String() string {
+	return calc.Disassemble()
+}
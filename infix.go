@@ -0,0 +1,340 @@
+package scalc
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+// infixPattern содержит шаблон выделения лексем инфиксного выражения:
+// строки в двойных кавычках, числа, идентификаторы (в том числе составные, через точку) и знаки операций
+var infixPattern = regexp.MustCompile(`^(?:"(?:[^"\\]|\\.)*"|(?:[0-9]+\.?[0-9]*|\.[0-9]+)(?:[eE][-+]?[0-9]+)?|[\pL_][\pL\pN_]*(?:\.[\pL_][\pL\pN_]*)*|\*\*|<<|>>|<=|>=|==|!=|<>|[-+*/%&|^~!=#<>(),])`)
+
+// infixOperators определяет бинарную операцию инфиксного выражения: имя операции окружения, приоритет и ассоциативность
+type infixOperators struct {
+	name       string // имя операции в наборе операций окружения
+	precedence int    // приоритет (большее значение - более высокий приоритет)
+	right      bool   // правоассоциативная операция
+}
+
+// infixBinary содержит бинарные операции инфиксного выражения
+var infixBinary = map[string]infixOperators{
+	"or":  {"or", 1, false},
+	"xor": {"xor", 1, false},
+	"and": {"and", 2, false},
+	"=":   {"=", 3, false},
+	"==":  {"=", 3, false},
+	"#":   {"#", 3, false},
+	"!=":  {"#", 3, false},
+	"<>":  {"#", 3, false},
+	"<":   {"<", 3, false},
+	">":   {">", 3, false},
+	"<=":  {"<=", 3, false},
+	">=":  {">=", 3, false},
+	"|":   {"|", 4, false},
+	"^":   {"^", 4, false},
+	"&":   {"&", 5, false},
+	"<<":  {"<<", 6, false},
+	">>":  {">>", 6, false},
+	"+":   {"+", 7, false},
+	"-":   {"-", 7, false},
+	"*":   {"*", 8, false},
+	"/":   {"/", 8, false},
+	"%":   {"%", 8, false},
+	"**":  {"**", 9, true},
+}
+
+// infixUnary содержит префиксные унарные операции инфиксного выражения и имена соответствующих им операций окружения
+// Операнд унарной операции связывается сильнее бинарных операций, кроме возведения в степень: -x ** 2 = -(x ** 2)
+var infixUnary = map[string]string{"-": "--", "!": "!", "not": "not", "~": "~"}
+
+// infixArguments содержит порядок аргументов в постфиксной записи для функций инфиксного выражения,
+// исходная строка которых записывается первым аргументом: replace(s, old, new) = old new s replace
+var infixArguments = map[string][]int{"replace": {1, 2, 0}, "regexReplace": {1, 2, 0}}
+
+// infixPrefix содержит приоритет операнда префиксной унарной операции
+const infixPrefix = 9
+
+// infixes определяет разбор инфиксного выражения
+type infixes struct {
+	env    *Environment
+	tokens []positions // лексемы выражения
+	pos    int         // номер текущей лексемы
+	end    int         // длина выражения в байтах
+}
+
+// NewInfix получает на вход строку, содержащую инфиксное выражение, и возвращает экземпляр калькулятора,
+// вычисляющего это выражение, с использованием окружения по умолчанию
+func NewInfix(expr string) (*Calculators, error) {
+	return defaultEnvironment.NewInfix(expr)
+}
+
+// NewInfix получает на вход строку, содержащую инфиксное выражение, например (price * qty) - discount,
+// и возвращает экземпляр калькулятора, вычисляющего это выражение с использованием набора операций окружения
+// Выражение преобразуется в ту же программу, что и эквивалентное постфиксное выражение (price @ qty @ * discount @ -):
+//   - идентификаторы являются именами параметров (name @); true и false - логические константы;
+//   - строковые константы записываются в двойных кавычках с экранированием Go;
+//   - бинарные операции по возрастанию приоритета: or xor, and, = == # != <> < > <= >=, | ^, &, << >>, + -, * / %, **
+//     (возведение в степень правоассоциативно), унарные операции: - (смена знака),
+//     ! (логическое NOT, допускает целое число: !0 = true), not (только логическое значение), ~;
+//   - операции и слова окружения вызываются как функции с аргументами в порядке постфиксной записи: max(a, b),
+//     format(".2f", x) (знак % добавляется операцией), left(s, 3); исключение - replace(s, old, new)
+//     и regexReplace(s, pattern, template), принимающие исходную строку первым аргументом: replace("abcab", "ab", "x") = "xcx" ('ab 'x 'abcab replace);
+//   - if(cond, a, b) вычисляет a или b в зависимости от истинности cond (? [ a ; b ])
+//
+// Положение ошибок указывается по лексемам инфиксного выражения
+func (env *Environment) NewInfix(expr string) (*Calculators, error) {
+	tokens, err := splitInfix(expr)
+	if err != nil {
+		return nil, err
+	}
+	env.lock.RLock()
+	inf := infixes{env: env, tokens: tokens, end: len(expr)}
+	tree, fail := inf.parse()
+	env.lock.RUnlock()
+	if fail != nil {
+		return nil, fail
+	}
+	return env.calculator(tree), nil
+}
+
+// splitInfix разбивает инфиксное выражение на лексемы с сохранением их положения в выражении
+func splitInfix(expr string) ([]positions, error) {
+	result := []positions{}
+	for offset := 0; offset < len(expr); {
+		char, size := utf8.DecodeRuneInString(expr[offset:])
+		if unicode.IsSpace(char) {
+			offset += size
+			continue
+		}
+		lexeme := infixPattern.FindString(expr[offset:])
+		pos := positions{lexeme, len(result), offset}
+		if lexeme == "" {
+			pos.lexeme = string(char)
+			if char == '"' {
+				return nil, failure(ErrSyntax, errors.New("string is not terminated")).at(pos)
+			}
+			return nil, failure(ErrSyntax, fmt.Errorf("character %#v is not valid", pos.lexeme)).at(pos)
+		}
+		result = append(result, pos)
+		offset += len(lexeme)
+	}
+	return result, nil
+}
+
+// parse разбирает инфиксное выражение и возвращает дерево разбора
+func (inf *infixes) parse() ([]nodes, *Error) {
+	if len(inf.tokens) == 0 {
+		return nil, failure(ErrSyntax, errors.New("expression is empty")).at(positions{"", 0, 0})
+	}
+	tree, err := inf.expression(0)
+	if err != nil {
+		return nil, err
+	} else if inf.pos < len(inf.tokens) {
+		return nil, inf.unexpected()
+	}
+	return tree, nil
+}
+
+// peek возвращает текущую лексему или пустую лексему в конце выражения
+func (inf *infixes) peek() positions {
+	if inf.pos < len(inf.tokens) {
+		return inf.tokens[inf.pos]
+	}
+	return positions{"", len(inf.tokens), inf.end}
+}
+
+// unexpected возвращает ошибку разбора текущей лексемы
+func (inf *infixes) unexpected() *Error {
+	token := inf.peek()
+	if token.lexeme == "" {
+		return failure(ErrSyntax, errors.New("unexpected end of expression")).at(token)
+	}
+	return failure(ErrSyntax, fmt.Errorf("unexpected %#v", token.lexeme)).at(token)
+}
+
+// expect пропускает лексему lexeme или возвращает ошибку, если текущая лексема отличается от неё
+func (inf *infixes) expect(lexeme string) *Error {
+	if inf.peek().lexeme != lexeme {
+		return inf.unexpected()
+	}
+	inf.pos++
+	return nil
+}
+
+// operation возвращает элемент дерева разбора операции окружения с именем name, соответствующей лексеме token
+func (inf *infixes) operation(name string, token positions) (nodes, *Error) {
+	op, exists := inf.env.actions[name]
+	if !exists {
+		return nodes{}, failure(ErrSyntax, fmt.Errorf("operation %#v is not available", name)).at(token)
+	}
+	return nodes{positions: positions{name, token.index, token.offset}, kind: nodeOperation, op: op}, nil
+}
+
+// expression разбирает выражение из бинарных операций с приоритетом не ниже min (метод precedence climbing)
+func (inf *infixes) expression(min int) ([]nodes, *Error) {
+	left, err := inf.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		token := inf.peek()
+		binary, exists := infixBinary[token.lexeme]
+		if !exists || binary.precedence < min {
+			return left, nil
+		}
+		inf.pos++
+		next := binary.precedence + 1
+		if binary.right {
+			next = binary.precedence
+		}
+		right, err := inf.expression(next)
+		if err != nil {
+			return nil, err
+		}
+		node, err := inf.operation(binary.name, token)
+		if err != nil {
+			return nil, err
+		}
+		left = append(append(left, right...), node)
+	}
+}
+
+// unary разбирает операнд с необязательной префиксной унарной операцией
+func (inf *infixes) unary() ([]nodes, *Error) {
+	token := inf.peek()
+	name, exists := infixUnary[token.lexeme]
+	if !exists {
+		return inf.primary()
+	}
+	inf.pos++
+	operand, err := inf.expression(infixPrefix)
+	if err != nil {
+		return nil, err
+	} else if name == "--" && len(operand) == 1 {
+		if node, ok := negate(operand[0], token); ok {
+			return []nodes{node}, nil
+		}
+	}
+	node, err := inf.operation(name, token)
+	if err != nil {
+		return nil, err
+	}
+	return append(operand, node), nil
+}
+
+// negate возвращает числовую константу node со знаком минус token, записанным перед ней
+// Число разбирается вместе со знаком, чтобы минимальное целое (-9223372036854775808) оставалось целым, как в New
+func negate(node nodes, token positions) (nodes, bool) {
+	if node.kind != nodeConstant {
+		return node, false
+	}
+	lexeme := "-" + node.lexeme
+	if value, err := strconv.ParseInt(lexeme, 10, 64); err == nil {
+		node.value = value
+	} else if value, ok := node.value.(float64); ok {
+		node.value = -value
+	} else if value, ok := node.value.(int64); ok {
+		node.value = -value
+	} else {
+		return node, false
+	}
+	node.positions = positions{lexeme, token.index, token.offset}
+	return node, true
+}
+
+// primary разбирает константу, параметр, вызов функции или выражение в скобках
+func (inf *infixes) primary() ([]nodes, *Error) {
+	token := inf.peek()
+	lexeme := token.lexeme
+	if lexeme == "" {
+		return nil, inf.unexpected()
+	}
+	inf.pos++
+	switch char, _ := utf8.DecodeRuneInString(lexeme); {
+	case lexeme == "(":
+		tree, err := inf.expression(0)
+		if err != nil {
+			return nil, err
+		}
+		return tree, inf.expect(")")
+	case char == '"':
+		value, err := strconv.Unquote(lexeme)
+		if err != nil {
+			return nil, failure(ErrSyntax, fmt.Errorf("string %s is not valid", lexeme)).at(token)
+		}
+		return []nodes{{positions: token, kind: nodeConstant, value: value}}, nil
+	case char == '.' || unicode.IsDigit(char):
+		if value, err := strconv.ParseInt(lexeme, 10, 64); err == nil {
+			return []nodes{{positions: token, kind: nodeConstant, value: value}}, nil
+		} else if value, err := strconv.ParseFloat(lexeme, 64); err == nil {
+			return []nodes{{positions: token, kind: nodeConstant, value: value}}, nil
+		}
+		return nil, failure(ErrSyntax, fmt.Errorf("number %s is not valid", lexeme)).at(token)
+	case char == '_' || unicode.IsLetter(char):
+		if _, exists := infixBinary[lexeme]; exists {
+			break
+		} else if lexeme == "true" || lexeme == "false" {
+			return []nodes{{positions: token, kind: nodeConstant, value: lexeme == "true"}}, nil
+		} else if inf.peek().lexeme == "(" {
+			return inf.call(token)
+		}
+		node, err := inf.operation("@", token)
+		if err != nil {
+			return nil, err
+		}
+		return []nodes{{positions: token, kind: nodeConstant, value: lexeme}, node}, nil
+	}
+	inf.pos--
+	return nil, inf.unexpected()
+}
+
+// call разбирает вызов функции name(arg, ...): операции или слова окружения либо if(cond, a, b)
+func (inf *infixes) call(token positions) ([]nodes, *Error) {
+	inf.pos++
+	args := [][]nodes{}
+	if inf.peek().lexeme == ")" {
+		inf.pos++
+	} else {
+		for {
+			arg, err := inf.expression(0)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if inf.peek().lexeme != "," {
+				break
+			}
+			inf.pos++
+		}
+		if err := inf.expect(")"); err != nil {
+			return nil, err
+		}
+	}
+
+	if token.lexeme == "if" {
+		if len(args) != 3 {
+			return nil, failure(ErrSyntax, fmt.Errorf("function %#v requires 3 arguments", token.lexeme)).at(token)
+		}
+		node := nodes{positions: positions{"?", token.index, token.offset}, kind: nodeCondition, branches: args[1:]}
+		return append(args[0], node), nil
+	}
+	node, err := inf.operation(token.lexeme, token)
+	if err != nil {
+		return nil, err
+	} else if node.op.arity > 0 && node.op.arity != len(args) {
+		return nil, failure(ErrSyntax, fmt.Errorf("function %#v requires %d arguments", token.lexeme, node.op.arity)).at(token)
+	}
+	var tree []nodes
+	order, reordered := infixArguments[token.lexeme]
+	for key, arg := range args {
+		if reordered && len(order) == len(args) {
+			arg = args[order[key]]
+		}
+		tree = append(tree, arg...)
+	}
+	return append(tree, node), nil
+}
@@ -0,0 +1,148 @@
+package scalc
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Limits определяет ограничения ресурсов, используемых при выполнении выражения
+// Нулевое значение поля означает отсутствие соответствующего ограничения
+// При превышении ограничения выполнение завершается ошибкой ErrLimit
+type Limits struct {
+	MaxSteps        int // допустимое количество выполняемых операций (включая повторения в циклах)
+	MaxStackDepth   int // допустимое количество значений в стеке
+	MaxStringLength int // допустимая длина строки в байтах (в том числе результата форматирования)
+	MaxRegexSize    int // допустимая длина шаблона регулярного выражения в байтах
+}
+
+// widthPattern содержит шаблон поиска ширины и точности в спецификациях строки форматирования
+var widthPattern = regexp.MustCompile("%%|%[-+# 0]*([0-9]*)(?:\\.([0-9]*))?")
+
+// valid проверяет допустимость ограничений
+func (limits Limits) valid() error {
+	if limits.MaxSteps < 0 || limits.MaxStackDepth < 0 || limits.MaxStringLength < 0 || limits.MaxRegexSize < 0 {
+		return errors.New("limits must not be negative")
+	}
+	return nil
+}
+
+// limit проверяет соблюдение ограничений после выполнения очередного шага выражения
+// Длина строки проверяется только для вершины стека: прочие операции помещают в стек не более одного нового значения,
+// а все результаты операций Stack проверяются самой операцией
+func (do *does) limit() {
+	do.steps++
+	if do.limits.MaxSteps > 0 && do.steps > do.limits.MaxSteps {
+		panic(failure(ErrLimit, fmt.Errorf("step count exceeds limit %d", do.limits.MaxSteps)))
+	}
+	if do.limits.MaxStackDepth > 0 && len(do.stack) > do.limits.MaxStackDepth {
+		panic(failure(ErrLimit, fmt.Errorf("stack depth %d exceeds limit %d", len(do.stack), do.limits.MaxStackDepth)))
+	}
+	if do.limits.MaxStringLength > 0 && len(do.stack) > 0 {
+		if str, ok := do.stack[len(do.stack)-1].(string); ok {
+			do.length(len(str))
+		}
+	}
+}
+
+// length проверяет, что длина строки не превышает допустимую
+func (do *does) length(length int) {
+	if do.limits != nil && do.limits.MaxStringLength > 0 && length > do.limits.MaxStringLength {
+		panic(failure(ErrLimit, fmt.Errorf("string length %d exceeds limit %d", length, do.limits.MaxStringLength)))
+	}
+}
+
+// operatorLimited является фабрикой операции, которая перед выполнением операции op
+// проверяет её операнды функцией guard (только при наличии ограничений)
+// Операция не считается чистой, чтобы оптимизатор не выполнял её при разборе в обход ограничений
+func operatorLimited(guard func(do *does), op Operation) Operation {
+	return Operation{
+		exec: func(do *does) {
+			if do.limits != nil {
+				guard(do)
+			}
+			op.exec(do)
+		},
+		check: op.check,
+		arity: op.arity,
+	}
+}
+
+// operand возвращает строковое значение, находящееся в стеке на глубине depth (с нуля), если оно существует
+func (do *does) operand(depth int) (string, bool) {
+	if depth >= len(do.stack) {
+		return "", false
+	}
+	str, ok := do.stack[len(do.stack)-1-depth].(string)
+	return str, ok
+}
+
+// guardRegex возвращает функцию проверки длины шаблона регулярного выражения, находящегося в стеке на глубине depth
+func guardRegex(depth int) func(do *does) {
+	return func(do *does) {
+		if str, ok := do.operand(depth); ok && do.limits.MaxRegexSize > 0 && len(str) > do.limits.MaxRegexSize {
+			panic(failure(ErrLimit, fmt.Errorf("regex size %d exceeds limit %d", len(str), do.limits.MaxRegexSize)))
+		}
+	}
+}
+
+// guardFormat проверяет ширину и точность строки форматирования до выполнения форматирования
+func guardFormat(do *does) {
+	format, ok := do.operand(1)
+	if !ok {
+		return
+	}
+	for _, match := range widthPattern.FindAllStringSubmatch("%"+format, -1) {
+		for _, width := range match[1:] {
+			if value, err := strconv.Atoi(width); err == nil {
+				do.length(value)
+			} else if width != "" {
+				do.length(math.MaxInt32)
+			}
+		}
+	}
+	if value, ok := do.stack[len(do.stack)-1].(int64); ok && strings.Contains(format, "*") {
+		if value < 0 {
+			value = -value
+		}
+		if value < 0 || value > math.MaxInt32 {
+			value = math.MaxInt32
+		}
+		do.length(int(value))
+	}
+}
+
+// guardReplace проверяет длину результата замены подстроки до выполнения замены
+func guardReplace(do *does) {
+	old, ok1 := do.operand(2)
+	str, ok2 := do.operand(1)
+	src, ok3 := do.operand(0)
+	if ok1 && ok2 && ok3 && len(str) > len(old) {
+		do.length(len(src) + strings.Count(src, old)*(len(str)-len(old)))
+	}
+}
+
+// guardRegexReplace проверяет длину шаблона регулярного выражения и длину результата замены до выполнения замены
+// Длина результата оценивается сверху: каждое вхождение заменяется не более чем текстом шаблона замены
+// и вхождением целиком на каждую ссылку на группу ($1, ${name}), поэтому результат не строится целиком
+func guardRegexReplace(do *does) {
+	guardRegex(2)(do)
+	expr, ok1 := do.operand(2)
+	template, ok2 := do.operand(1)
+	src, ok3 := do.operand(0)
+	if !ok1 || !ok2 || !ok3 || do.limits.MaxStringLength <= 0 {
+		return
+	}
+	regex, err := regexp.Compile(expr)
+	if err != nil {
+		return
+	}
+	refs, length := strings.Count(template, "$"), len(src)
+	for _, match := range regex.FindAllStringIndex(src, -1) {
+		length += len(template) + (refs-1)*(match[1]-match[0])
+	}
+	do.length(length)
+}
@@ -0,0 +1,302 @@
+package scalc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// binaryMagic содержит сигнатуру двоичного представления калькулятора
+const binaryMagic = "scalc"
+
+// binaryVersion содержит версию формата двоичного представления калькулятора
+const binaryVersion = 1
+
+// errFormat возвращается при разборе повреждённого двоичного представления калькулятора
+var errFormat = errors.New("binary format is not valid")
+
+// теги типов констант двоичного представления калькулятора
+const (
+	tagInt64 byte = iota + 1
+	tagFloat64
+	tagString
+	tagBool
+)
+
+// MarshalText возвращает исходное выражение калькулятора в каноническом виде (см. Environment.Format)
+func (calc *Calculators) MarshalText() ([]byte, error) {
+	return []byte(calc.source), nil
+}
+
+// UnmarshalText разбирает выражение text с использованием окружения по умолчанию и заменяет им калькулятор calc
+func (calc *Calculators) UnmarshalText(text []byte) error {
+	result, err := New(string(text))
+	if err != nil {
+		return err
+	}
+	*calc = *result
+	return nil
+}
+
+// MarshalBinary возвращает двоичное представление скомпилированной программы калькулятора
+// Представление содержит версию формата, исходное выражение и инструкции программы;
+// операции сохраняются по именам и восстанавливаются из окружения при загрузке
+func (calc *Calculators) MarshalBinary() ([]byte, error) {
+	buffer := bytes.NewBufferString(binaryMagic)
+	buffer.WriteByte(binaryVersion)
+	writeString(buffer, calc.source)
+	writeUint(buffer, uint64(len(calc.program)))
+	for _, in := range calc.program {
+		buffer.WriteByte(byte(in.code))
+		writeString(buffer, in.lexeme)
+		writeInt(buffer, int64(in.index))
+		writeInt(buffer, int64(in.offset))
+		switch in.code {
+		case opOperation:
+		case opConstant:
+			if err := writeValue(buffer, in.value); err != nil {
+				return nil, err
+			}
+		case opStore, opFetch, opOutput:
+			writeString(buffer, in.value.(string))
+		case opSwitch:
+			writeUint(buffer, uint64(len(in.table)))
+			for _, jump := range in.table {
+				writeInt(buffer, int64(jump))
+			}
+			if in.fallback {
+				buffer.WriteByte(1)
+			} else {
+				buffer.WriteByte(0)
+			}
+		default:
+			writeInt(buffer, int64(in.jump))
+		}
+	}
+	return buffer.Bytes(), nil
+}
+
+// UnmarshalBinary загружает двоичное представление программы с использованием окружения по умолчанию
+// и заменяет ей калькулятор calc
+func (calc *Calculators) UnmarshalBinary(data []byte) error {
+	result, err := defaultEnvironment.Load(data)
+	if err != nil {
+		return err
+	}
+	*calc = *result
+	return nil
+}
+
+// Load создаёт калькулятор из двоичного представления программы, полученного методом Calculators.MarshalBinary
+// Операции программы восстанавливаются из набора операций окружения, ограничения выполнения также берутся из окружения
+// Возвращает ошибку, если формат или версия представления недопустимы либо какая-либо из операций не существует в окружении
+func (env *Environment) Load(data []byte) (*Calculators, error) {
+	reader := bytes.NewReader(data)
+	magic := make([]byte, len(binaryMagic))
+	if _, err := reader.Read(magic); err != nil || string(magic) != binaryMagic {
+		return nil, errFormat
+	}
+	if version, err := reader.ReadByte(); err != nil {
+		return nil, errFormat
+	} else if version != binaryVersion {
+		return nil, fmt.Errorf("binary format version %d is not supported", version)
+	}
+	source, err := readString(reader)
+	if err != nil {
+		return nil, err
+	}
+	count, err := readUint(reader)
+	if err != nil || count > uint64(reader.Len()) {
+		return nil, errFormat
+	}
+
+	env.lock.RLock()
+	defer env.lock.RUnlock()
+	program := make([]instructions, count)
+	for key := range program {
+		if program[key], err = env.readInstruction(reader); err != nil {
+			return nil, err
+		}
+	}
+	if reader.Len() > 0 || !validJumps(program) {
+		return nil, errFormat
+	}
+	return &Calculators{program, env.loops, env.limits, source}, nil
+}
+
+// readInstruction читает инструкцию программы, восстанавливая операции из набора операций окружения
+func (env *Environment) readInstruction(reader *bytes.Reader) (in instructions, err error) {
+	code, err := reader.ReadByte()
+	if err != nil || int(code) >= len(opcodeNames) {
+		return in, errFormat
+	}
+	in.code = opcodes(code)
+	if in.lexeme, err = readString(reader); err != nil {
+		return
+	}
+	index, err1 := readInt(reader)
+	offset, err2 := readInt(reader)
+	if err1 != nil || err2 != nil {
+		return in, errFormat
+	}
+	in.index, in.offset = int(index), int(offset)
+	switch in.code {
+	case opOperation:
+		op, exists := env.actions[in.lexeme]
+		if !exists {
+			return in, failure(ErrSyntax, fmt.Errorf("operation %#v is not available", in.lexeme)).at(in.positions)
+		}
+		in.exec = op.exec
+	case opConstant:
+		in.value, err = readValue(reader)
+	case opStore, opFetch, opOutput:
+		in.value, err = readString(reader)
+	case opSwitch:
+		var count uint64
+		if count, err = readUint(reader); err != nil || count < 2 || count > uint64(reader.Len()) {
+			return in, errFormat
+		}
+		in.table = make([]int, count)
+		for key := range in.table {
+			jump, err := readInt(reader)
+			if err != nil {
+				return in, err
+			}
+			in.table[key] = int(jump)
+		}
+		var flag byte
+		flag, err = reader.ReadByte()
+		in.fallback = flag == 1
+	default:
+		var jump int64
+		jump, err = readInt(reader)
+		in.jump = int(jump)
+	}
+	if err != nil {
+		return in, errFormat
+	}
+	return
+}
+
+// validJumps проверяет, что все переходы программы указывают на её инструкции
+func validJumps(program []instructions) bool {
+	valid := func(pc, jump int) bool {
+		target := pc + 1 + jump
+		return target >= 0 && target < len(program)
+	}
+	for pc, in := range program {
+		switch in.code {
+		case opSwitch:
+			for _, jump := range in.table {
+				if !valid(pc, jump) {
+					return false
+				}
+			}
+		case opJump, opJumpFalse, opTimes, opNext, opWhile, opCall:
+			if !valid(pc, in.jump) {
+				return false
+			}
+		}
+	}
+	return len(program) == 0 || program[len(program)-1].code == opReturn
+}
+
+// writeUint записывает целое без знака в формате varint
+func writeUint(buffer *bytes.Buffer, value uint64) {
+	temp := [binary.MaxVarintLen64]byte{}
+	buffer.Write(temp[:binary.PutUvarint(temp[:], value)])
+}
+
+// writeInt записывает целое со знаком в формате varint
+func writeInt(buffer *bytes.Buffer, value int64) {
+	temp := [binary.MaxVarintLen64]byte{}
+	buffer.Write(temp[:binary.PutVarint(temp[:], value)])
+}
+
+// writeString записывает строку с предшествующей ей длиной
+func writeString(buffer *bytes.Buffer, value string) {
+	writeUint(buffer, uint64(len(value)))
+	buffer.WriteString(value)
+}
+
+// writeValue записывает значение константы с предшествующим ему тегом типа
+func writeValue(buffer *bytes.Buffer, value interface{}) error {
+	switch value := value.(type) {
+	case int64:
+		buffer.WriteByte(tagInt64)
+		writeInt(buffer, value)
+	case float64:
+		buffer.WriteByte(tagFloat64)
+		writeUint(buffer, math.Float64bits(value))
+	case string:
+		buffer.WriteByte(tagString)
+		writeString(buffer, value)
+	case bool:
+		buffer.WriteByte(tagBool)
+		if value {
+			buffer.WriteByte(1)
+		} else {
+			buffer.WriteByte(0)
+		}
+	default:
+		return fmt.Errorf("constant type %v is not valid", kindOf(value))
+	}
+	return nil
+}
+
+// readUint читает целое без знака в формате varint
+func readUint(reader *bytes.Reader) (uint64, error) {
+	value, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return 0, errFormat
+	}
+	return value, nil
+}
+
+// readInt читает целое со знаком в формате varint
+func readInt(reader *bytes.Reader) (int64, error) {
+	value, err := binary.ReadVarint(reader)
+	if err != nil {
+		return 0, errFormat
+	}
+	return value, nil
+}
+
+// readString читает строку с предшествующей ей длиной
+func readString(reader *bytes.Reader) (string, error) {
+	length, err := readUint(reader)
+	if err != nil || length > uint64(reader.Len()) {
+		return "", errFormat
+	}
+	result := make([]byte, length)
+	if _, err := reader.Read(result); err != nil && length > 0 {
+		return "", errFormat
+	}
+	return string(result), nil
+}
+
+// readValue читает значение константы с предшествующим ему тегом типа
+func readValue(reader *bytes.Reader) (interface{}, error) {
+	tag, err := reader.ReadByte()
+	if err != nil {
+		return nil, errFormat
+	}
+	switch tag {
+	case tagInt64:
+		return readInt(reader)
+	case tagFloat64:
+		bits, err := readUint(reader)
+		return math.Float64frombits(bits), err
+	case tagString:
+		return readString(reader)
+	case tagBool:
+		flag, err := reader.ReadByte()
+		if err != nil || flag > 1 {
+			return nil, errFormat
+		}
+		return flag == 1, nil
+	}
+	return nil, errFormat
+}
@@ -0,0 +1,7 @@
+//go:build !race
+// +build !race
+
+package scalc
+
+// raceEnabled указывает, что тесты собраны с детектором гонок: sync.Pool при этом случайно отбрасывает объекты
+const raceEnabled = false
@@ -0,0 +1,166 @@
+package scalc
+
+// optimizers определяет оптимизатор дерева разбора выражения
+type optimizers struct {
+	result []nodes // оптимизированная последовательность элементов дерева разбора
+	limits *Limits // ограничения ресурсов выполнения выражения (nil, если ограничения не заданы)
+}
+
+// maxFolded содержит наибольшую длину строки, получаемой при вычислении операций над константами при разборе;
+// более длинные строки вычисляются при выполнении выражения с проверкой ограничений
+const maxFolded = 1024
+
+// optimize выполняет оптимизацию дерева разбора: вычисляет чистые операции над константами,
+// устраняет пары dup drop и swap swap и заменяет ветвления с константным условием выбранным вариантом
+// Операции, выполнение которых над константами завершается ошибкой или даёт строку длиннее maxFolded
+// (или допустимой ограничениями limits), сохраняются для выполнения
+func optimize(tree []nodes, limits *Limits) []nodes {
+	opt := optimizers{make([]nodes, 0, len(tree)), limits}
+	for _, node := range tree {
+		opt.push(node)
+	}
+	return opt.result
+}
+
+// push добавляет элемент дерева разбора в оптимизированную последовательность
+func (opt *optimizers) push(node nodes) {
+	switch node.kind {
+	case nodeOperation:
+		if opt.fold(node) || opt.cancel(node) {
+			return
+		}
+	case nodeSelect, nodeCondition:
+		branches := make([][]nodes, len(node.branches))
+		for key, branch := range node.branches {
+			branches[key] = optimize(branch, opt.limits)
+		}
+		node.branches = branches
+		if branch, ok := opt.resolve(node); ok {
+			for _, item := range branch {
+				opt.push(item)
+			}
+			return
+		}
+	case nodeTimes, nodeWhile:
+		branches := make([][]nodes, len(node.branches))
+		for key, branch := range node.branches {
+			branches[key] = optimize(branch, opt.limits)
+		}
+		node.branches = branches
+	case nodeDefinition:
+		node.word.body = optimize(node.word.body, opt.limits)
+	}
+	opt.result = append(opt.result, node)
+}
+
+// constants возвращает значения count последних элементов оптимизированной последовательности,
+// если все они являются константами
+func (opt *optimizers) constants(count int) ([]interface{}, bool) {
+	start := len(opt.result) - count
+	if start < 0 {
+		return nil, false
+	}
+	values := make([]interface{}, 0, count+1)
+	for _, item := range opt.result[start:] {
+		if item.kind != nodeConstant {
+			return nil, false
+		}
+		values = append(values, item.value)
+	}
+	return values, true
+}
+
+// fold вычисляет чистую операцию над константами и заменяет их результатом операции
+func (opt *optimizers) fold(node nodes) bool {
+	if !node.op.pure {
+		return false
+	}
+	values, ok := opt.constants(node.op.arity)
+	if !ok {
+		return false
+	}
+	do := does{stack: values, loops: DefaultLoopLimit}
+	if !do.safely(node.op.exec) || !opt.allowed(do.stack) {
+		return false
+	}
+	opt.result = opt.result[:len(opt.result)-node.op.arity]
+	for _, value := range do.stack {
+		opt.result = append(opt.result, nodes{positions: node.positions, kind: nodeConstant, value: value})
+	}
+	return true
+}
+
+// allowed проверяет, что длина строковых результатов вычисления над константами не превышает maxFolded
+// и допустимой ограничениями длины строки
+func (opt *optimizers) allowed(values []interface{}) bool {
+	length := maxFolded
+	if opt.limits != nil && opt.limits.MaxStringLength > 0 && opt.limits.MaxStringLength < length {
+		length = opt.limits.MaxStringLength
+	}
+	for _, value := range values {
+		if str, ok := value.(string); ok && len(str) > length {
+			return false
+		}
+	}
+	return true
+}
+
+// cancel устраняет пары операций dup drop и swap swap, если значения, над которыми они выполняются,
+// заведомо находятся в стеке (по модели стека статической проверки); в противном случае пара сохраняется,
+// чтобы выполнение завершилось той же ошибкой недостатка значений в стеке
+func (opt *optimizers) cancel(node nodes) bool {
+	last := len(opt.result) - 1
+	if last < 0 || node.op.builtin == "" || opt.result[last].kind != nodeOperation {
+		return false
+	}
+	count := 0
+	if prev := opt.result[last].op.builtin; prev == "dup" && node.op.builtin == "drop" {
+		count = 1
+	} else if prev == "swap" && node.op.builtin == "swap" {
+		count = 2
+	} else {
+		return false
+	}
+	chk := checks{}
+	if chk.run(opt.result[:last]) != nil || len(chk.stack) < count {
+		return false
+	}
+	opt.result = opt.result[:last]
+	return true
+}
+
+// resolve возвращает вариант ветвления, выбираемый константным индексом (условием), и удаляет эту константу
+func (opt *optimizers) resolve(node nodes) ([]nodes, bool) {
+	values, ok := opt.constants(1)
+	if !ok {
+		return nil, false
+	}
+	var branch []nodes
+	if node.kind == nodeCondition {
+		if truthy(values[0]) {
+			branch = node.branches[0]
+		} else if len(node.branches) > 1 {
+			branch = node.branches[1]
+		}
+	} else {
+		do := does{stack: values}
+		var code int
+		if !do.safely(func(do *does) { code = do.index(len(node.branches), node.fallback) }) {
+			return nil, false
+		}
+		branch = node.branches[code]
+	}
+	opt.result = opt.result[:len(opt.result)-1]
+	return branch, true
+}
+
+// safely выполняет операцию и возвращает признак её успешного выполнения
+func (do *does) safely(op operators) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	op(do)
+	return true
+}
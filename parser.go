@@ -2,60 +2,253 @@ package scalc
 
 import (
 	"errors"
+	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
+	"unicode"
 )
 
 var (
-	// splitPattern содержит шаблон разюивки исходного выражения на лексемы
-	splitPattern = regexp.MustCompile("\\s+")
+	// lexemePattern содержит шаблон выделения лексем из исходного выражения
+	lexemePattern = regexp.MustCompile("\\S+")
 	// escapePattern содержит шаблон посика в лексеме "строковая константа" специальных символов
 	escapePattern = regexp.MustCompile("\\\\.")
+	// localPattern содержит шаблон лексем сохранения (!name, ->name) и получения ($name) значения локальной переменной
+	// и сохранения значения в выходном параметре (=>name)
+	localPattern = regexp.MustCompile("^(!|->|\\$|=>)([\\pL_][\\pL\\pN_]*)$")
 )
 
+// nodeKinds определяет вид элемента дерева разбора выражения
+type nodeKinds int
+
+const (
+	nodeConstant   nodeKinds = iota // константа
+	nodeOperation                   // операция из набора actions
+	nodeSelect                      // ветвление по индексу (switch)
+	nodeCondition                   // условное ветвление (? [ then ; else ])
+	nodeTimes                       // цикл с заданным количеством повторений (times [ body ])
+	nodeWhile                       // цикл с условием (while [ cond ; body ])
+	nodeDefinition                  // определение пользовательского слова (: name body ;)
+	nodeCall                        // вызов пользовательского слова
+	nodeStore                       // сохранение значения в локальной переменной (!name или ->name)
+	nodeFetch                       // запись в стек значения локальной переменной ($name)
+	nodeOutput                      // сохранение значения в выходном параметре (=>name)
+)
+
+// prefixes содержит лексемы, которые должны непосредственно предшествовать открывающей скобке,
+// и виды соответствующих им элементов дерева разбора
+var prefixes = map[string]nodeKinds{"?": nodeCondition, "times": nodeTimes, "while": nodeWhile}
+
+// sections содержит допустимое количество вариантов для элементов дерева разбора с фиксированным количеством вариантов
+var sections = map[nodeKinds]int{nodeCondition: 2, nodeTimes: 1, nodeWhile: 2}
+
+// positions определяет лексему и её положение в исходном выражении
+type positions struct {
+	lexeme string // лексема
+	index  int    // порядковый номер лексемы (с нуля)
+	offset int    // смещение лексемы в байтах
+}
+
+// nodes определяет элемент дерева разбора выражения
+type nodes struct {
+	positions
+	kind     nodeKinds
+	op       Operation   // операция (для nodeOperation)
+	value    interface{} // значение константы (для nodeConstant) или имя переменной (для nodeStore, nodeFetch, nodeOutput)
+	branches [][]nodes   // варианты ветвления или тело цикла (для nodeSelect, nodeCondition, nodeTimes, nodeWhile)
+	fallback bool        // последний вариант ветвления является вариантом по умолчанию (для nodeSelect)
+	word     *words      // пользовательское слово (для nodeDefinition и nodeCall)
+}
+
+// words определяет пользовательское слово (подпрограмму), заданное определением : name body ;
+type words struct {
+	name    string         // имя слова
+	body    []nodes        // дерево разбора тела слова
+	program []instructions // программа библиотечного слова, скомпилированная однократно для всех вызовов
+}
+
+// frames определяет открытое ветвление или определение слова при разборе выражения
+type frames struct {
+	positions           // положение открывающей скобки или предшествующей ей лексемы
+	kind      nodeKinds // вид ветвления
+	fallback  bool      // ветвление содержит вариант по умолчанию
+	word      *words    // определяемое слово (для nodeDefinition)
+}
+
 // New получает на вход строку, содержащую выражение, и возвращает экземпляр калькулятора, вычисляющего это выражение
 func New(expr string) (*Calculators, error) {
-	buffer := [][][]operators{{{}}}
+	return defaultEnvironment.New(expr)
+}
+
+// NewChecked работает аналогично New, но дополнительно выполняет статическую проверку выражения:
+// моделирует глубину стека и типы значений на каждой операции (включая все варианты ветвлений)
+// и возвращает ошибку, если выражение заведомо не может быть выполнено
+func NewChecked(expr string) (*Calculators, error) {
+	return defaultEnvironment.NewChecked(expr)
+}
+
+// parse разбирает строку, содержащую выражение, и возвращает дерево разбора
+// Ошибки разбора возвращаются в виде *Error
+func (env *Environment) parse(expr string) ([]nodes, error) {
+	env.lock.RLock()
+	defer env.lock.RUnlock()
+
+	buffer := [][][]nodes{{{}}}
+	opens := []frames{}            // открытые ветвления и определения слов
+	var prefix *frames             // лексема, ожидающая открывающей скобки
+	var naming *positions          // лексема :, ожидающая имени определяемого слова
+	defined := map[string]*words{} // слова, определённые в выражении
+	var defining *words            // определяемое слово
+	stored := map[string]bool{}    // локальные переменные, в которые выражение сохраняет значения
+	fetched := []positions{}       // лексемы, получающие значения локальных переменных
 
 	level := 0
 	section := 0
-	for _, lexeme := range splitPattern.Split(strings.TrimSpace(expr), -1) {
-		if op, exists := actions[lexeme]; exists {
-			buffer[level][section] = append(buffer[level][section], op)
+	for _, pos := range split(expr) {
+		lexeme := pos.lexeme
+		if prefix != nil && lexeme != "[" {
+			return nil, failure(ErrSyntax, fmt.Errorf("%s without [", prefix.lexeme)).at(prefix.positions)
+		}
+		if naming != nil {
+			if err := validName(lexeme); err != nil {
+				return nil, failure(ErrSyntax, err).at(pos)
+			} else if _, exists := env.actions[lexeme]; exists || defined[lexeme] != nil || env.removed[lexeme] {
+				return nil, failure(ErrSyntax, fmt.Errorf("operation %#v already exists", lexeme)).at(pos)
+			}
+			defining = &words{name: lexeme}
+			buffer = append(buffer, [][]nodes{{}})
+			opens = append(opens, frames{positions: *naming, kind: nodeDefinition, word: defining})
+			naming = nil
+			level++
+			section = 0
+		} else if word := defined[lexeme]; word != nil {
+			buffer[level][section] = append(buffer[level][section], nodes{positions: pos, kind: nodeCall, word: word})
+		} else if defining != nil && lexeme == defining.name {
+			return nil, failure(ErrSyntax, fmt.Errorf("recursive call of %#v is not allowed", lexeme)).at(pos)
+		} else if op, exists := env.actions[lexeme]; exists {
+			buffer[level][section] = append(buffer[level][section], nodes{positions: pos, kind: nodeOperation, op: op})
+		} else if env.removed[lexeme] {
+			return nil, failure(ErrSyntax, fmt.Errorf("operation %#v is not available", lexeme)).at(pos)
+		} else if name, kind := localName(lexeme); name != "" {
+			if kind == nodeStore {
+				stored[name] = true
+			} else if kind == nodeFetch {
+				fetched = append(fetched, pos)
+			}
+			buffer[level][section] = append(buffer[level][section], nodes{positions: pos, kind: kind, value: name})
+		} else if lexeme == ":" {
+			if level > 0 {
+				return nil, failure(ErrSyntax, errors.New(": inside [] or definition")).at(pos)
+			}
+			naming = &positions{pos.lexeme, pos.index, pos.offset}
+		} else if kind, exists := prefixes[lexeme]; exists {
+			prefix = &frames{positions: pos, kind: kind}
 		} else if lexeme == "[" {
-			buffer = append(buffer, [][]operators{{}})
+			if prefix == nil {
+				prefix = &frames{positions: pos, kind: nodeSelect}
+			}
+			buffer = append(buffer, [][]nodes{{}})
+			opens = append(opens, *prefix)
+			prefix = nil
 			level++
 			section = 0
 		} else if lexeme == "]" {
-			if level == 0 {
-				return nil, errors.New("] without [")
+			if level == 0 || opens[level-1].kind == nodeDefinition {
+				return nil, failure(ErrSyntax, errors.New("] without [")).at(pos)
 			}
-			temp := operatorSelect(buffer[level])
+			frame := opens[level-1]
+			if frame.kind == nodeWhile && section == 0 {
+				return nil, failure(ErrSyntax, errors.New("while requires cond ; body sections")).at(pos)
+			}
+			temp := nodes{positions: frame.positions, kind: frame.kind, branches: buffer[level], fallback: frame.fallback}
 			buffer = buffer[:level]
+			opens = opens[:len(opens)-1]
 			level--
 			section = len(buffer[level]) - 1
 			buffer[level][section] = append(buffer[level][section], temp)
-		} else if lexeme == ";" {
-			if level == 0 {
-				return nil, errors.New("; outside []")
+		} else if lexeme == ";" && level > 0 && opens[level-1].kind == nodeDefinition {
+			frame := opens[level-1]
+			frame.word.body = buffer[level][0]
+			defined[frame.word.name] = frame.word
+			defining = nil
+			buffer = buffer[:level]
+			opens = opens[:len(opens)-1]
+			level--
+			buffer[level][section] = append(buffer[level][section], nodes{positions: frame.positions, kind: nodeDefinition, word: frame.word})
+		} else if lexeme == ";" || lexeme == "else" {
+			if level == 0 || opens[level-1].kind == nodeDefinition {
+				return nil, failure(ErrSyntax, fmt.Errorf("%s outside []", lexeme)).at(pos)
 			}
-			buffer[level] = append(buffer[level], []operators{})
+			frame := &opens[level-1]
+			if frame.fallback {
+				return nil, failure(ErrSyntax, fmt.Errorf("%s after else", lexeme)).at(pos)
+			} else if count, exists := sections[frame.kind]; exists && (lexeme == "else" || section+1 >= count) {
+				return nil, failure(ErrSyntax, fmt.Errorf("%s allows only %d sections", frame.lexeme, count)).at(pos)
+			}
+			frame.fallback = lexeme == "else"
+			buffer[level] = append(buffer[level], []nodes{})
 			section++
 		} else if value, err := strconv.ParseInt(lexeme, 10, 64); err == nil {
-			buffer[level][section] = append(buffer[level][section], operatorConstant(value))
+			buffer[level][section] = append(buffer[level][section], nodes{positions: pos, kind: nodeConstant, value: value})
 		} else if value, err := strconv.ParseFloat(lexeme, 64); err == nil {
-			buffer[level][section] = append(buffer[level][section], operatorConstant(value))
+			buffer[level][section] = append(buffer[level][section], nodes{positions: pos, kind: nodeConstant, value: value})
+		} else if lexeme == "true" || lexeme == "false" {
+			buffer[level][section] = append(buffer[level][section], nodes{positions: pos, kind: nodeConstant, value: lexeme == "true"})
 		} else if len(lexeme) > 0 && lexeme[0] == '\'' {
-			buffer[level][section] = append(buffer[level][section], operatorConstant(convertString(lexeme[1:])))
+			buffer[level][section] = append(buffer[level][section], nodes{positions: pos, kind: nodeConstant, value: convertString(lexeme[1:])})
 		} else {
-			buffer[level][section] = append(buffer[level][section], operatorConstant(convertString(lexeme)))
+			buffer[level][section] = append(buffer[level][section], nodes{positions: pos, kind: nodeConstant, value: convertString(lexeme)})
 		}
 	}
-	if level > 0 {
-		return nil, errors.New("[ without ]")
+	if prefix != nil {
+		return nil, failure(ErrSyntax, fmt.Errorf("%s without [", prefix.lexeme)).at(prefix.positions)
+	} else if naming != nil {
+		return nil, failure(ErrSyntax, errors.New(": without name")).at(*naming)
+	} else if level > 0 && opens[level-1].kind == nodeDefinition {
+		return nil, failure(ErrSyntax, errors.New(": without ;")).at(opens[level-1].positions)
+	} else if level > 0 {
+		return nil, failure(ErrSyntax, errors.New("[ without ]")).at(opens[level-1].positions)
+	}
+	for _, pos := range fetched {
+		if name, _ := localName(pos.lexeme); !stored[name] {
+			return nil, failure(ErrSyntax, fmt.Errorf("local %#v is never stored", name)).at(pos)
+		}
+	}
+	return buffer[0][0], nil
+}
+
+// localName возвращает имя переменной и вид элемента дерева разбора, если лексема является сохранением (!name, ->name)
+// или получением ($name) значения локальной переменной либо сохранением значения в выходном параметре (=>name)
+func localName(lexeme string) (name string, kind nodeKinds) {
+	match := localPattern.FindStringSubmatch(lexeme)
+	if match == nil {
+		return "", nodeConstant
+	}
+	switch match[1] {
+	case "$":
+		return match[2], nodeFetch
+	case "=>":
+		return match[2], nodeOutput
+	default:
+		return match[2], nodeStore
+	}
+}
+
+// split разбивает выражение на лексемы с сохранением их положения в выражении
+// Пустое выражение содержит единственную пустую лексему
+func split(expr string) []positions {
+	start := len(expr) - len(strings.TrimLeftFunc(expr, unicode.IsSpace))
+	trimmed := strings.TrimSpace(expr)
+	bounds := lexemePattern.FindAllStringIndex(trimmed, -1)
+	if len(bounds) == 0 {
+		return []positions{{"", 0, start}}
+	}
+	result := make([]positions, len(bounds))
+	for key, bound := range bounds {
+		result[key] = positions{trimmed[bound[0]:bound[1]], key, start + bound[0]}
 	}
-	return &Calculators{buffer[0][0]}, nil
+	return result
 }
 
 // convertString производит замену в строке специальных символов
@@ -0,0 +1,162 @@
+package scalc
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// reserved содержит лексемы, которые не могут быть именами операций
+var reserved = map[string]bool{"[": true, "]": true, ";": true, ":": true, "?": true, "else": true, "times": true, "while": true, "true": true, "false": true}
+
+// StackActions определяет произвольную операцию над стеком:
+// получает стек калькулятора и возвращает его новое состояние
+// Стек повторно используется последующими вычислениями, поэтому действие не должно сохранять ссылку на него
+type StackActions func(stack []interface{}) ([]interface{}, error)
+
+// Unary создаёт пользовательскую унарную операцию с типом результата result
+// (Same - тип аргумента, Any - тип не определён статически)
+// Действия должны возвращать значения типов int64, float64, string или bool
+// Паникует, если набор действий пуст или содержит недопустимые типы значений
+// Операция не считается чистой (см. Operation.Pure)
+func Unary(result reflect.Kind, actions UnaryActions) Operation {
+	mustResult(result, len(actions))
+	for kind, fn := range actions {
+		mustAction(fn != nil, kind)
+	}
+	op := operatorUnary(result, actions)
+	op.pure = false
+	return op
+}
+
+// Binary создаёт пользовательскую бинарную операцию с типом результата result
+// (Same - тип первого аргумента, Any - тип не определён статически)
+// Действия должны возвращать значения типов int64, float64, string или bool
+// Паникует, если набор действий пуст или содержит недопустимые типы значений
+// Операция не считается чистой (см. Operation.Pure)
+func Binary(result reflect.Kind, actions BinaryActions) Operation {
+	mustResult(result, len(actions))
+	for kinds, fn := range actions {
+		mustAction(fn != nil, kinds[:]...)
+	}
+	op := operatorBinary(result, actions)
+	op.pure = false
+	return op
+}
+
+// Ternary создаёт пользовательскую тернарную операцию с типом результата result
+// (Same - тип первого аргумента, Any - тип не определён статически)
+// Действия должны возвращать значения типов int64, float64, string или bool
+// Паникует, если набор действий пуст или содержит недопустимые типы значений
+// Операция не считается чистой (см. Operation.Pure)
+func Ternary(result reflect.Kind, actions TernaryActions) Operation {
+	mustResult(result, len(actions))
+	for kinds, fn := range actions {
+		mustAction(fn != nil, kinds[:]...)
+	}
+	op := operatorTernary(result, actions)
+	op.pure = false
+	return op
+}
+
+// Stack создаёт пользовательскую операцию, произвольно изменяющую стек:
+// in определяет типы значений, снимаемых операцией с вершины стека, out - типы значений, помещаемых в стек
+// (Any - значение любого типа). Действие action получает весь стек и возвращает его новое состояние,
+// которое должно соответствовать стековому эффекту операции
+// Паникует, если in или out содержат недопустимые типы значений
+func Stack(in, out []reflect.Kind, action StackActions) Operation {
+	for _, kinds := range [][]reflect.Kind{in, out} {
+		for _, kind := range kinds {
+			if !validKinds[kind] && kind != Any {
+				panic(fmt.Errorf("scalc: operation value type %v is not valid", kind))
+			}
+		}
+	}
+	mustAction(action != nil)
+	return operatorStack(in, out, action)
+}
+
+// operatorStack является фабрикой операций, произвольно изменяющих стек
+func operatorStack(in, out []reflect.Kind, action StackActions) Operation {
+	return Operation{
+		exec: func(do *does) {
+			do.need(len(in))
+			start := len(do.stack) - len(in)
+			for key, kind := range in {
+				if temp := kindOf(do.stack[start+key]); kind != Any && kind != temp {
+					panic(mismatch(temp))
+				}
+			}
+			stack, err := action(do.stack)
+			if err != nil {
+				panic(err)
+			} else if len(stack) != start+len(out) {
+				panic(failure(ErrStackEffect, fmt.Errorf("stack size %d is not equal to %d", len(stack), start+len(out))))
+			}
+			for key, kind := range out {
+				if temp := kindOf(stack[start+key]); kind != Any && kind != temp {
+					panic(failure(ErrStackEffect, fmt.Errorf("result type %v is not equal to %v", temp, kind)))
+				} else if str, ok := stack[start+key].(string); ok {
+					do.length(len(str))
+				}
+			}
+			do.stack = stack
+		},
+		check: func(chk *checks) *Error {
+			kinds, err := chk.pop(len(in))
+			if err != nil {
+				return err
+			} else if !matchKinds(kinds, in) {
+				return mismatch(kinds...)
+			}
+			chk.push(out...)
+			return nil
+		},
+		arity: len(in),
+	}
+}
+
+// NewError создаёт ошибку заданной категории
+// Пользовательские операции могут паниковать такой ошибкой для сообщения о недопустимых значениях операндов
+func NewError(category Categories, err error) *Error {
+	return failure(category, err)
+}
+
+// validName проверяет допустимость имени операции: имя должно быть одной лексемой,
+// не совпадающей со служебной лексемой или константой
+func validName(name string) error {
+	if name == "" || strings.TrimSpace(name) != name || lexemePattern.FindString(name) != name {
+		return fmt.Errorf("operation name %#v is not valid", name)
+	} else if local, _ := localName(name); reserved[name] || name[0] == '\'' || local != "" {
+		return fmt.Errorf("operation name %#v is reserved", name)
+	} else if _, err := strconv.ParseFloat(name, 64); err == nil {
+		return fmt.Errorf("operation name %#v is a number", name)
+	}
+	return nil
+}
+
+// validKinds содержит допустимые типы значений стека
+var validKinds = map[reflect.Kind]bool{reflect.Int64: true, reflect.Float64: true, reflect.String: true, reflect.Bool: true}
+
+// mustResult проверяет допустимость типа результата и наличие действий пользовательской операции
+func mustResult(result reflect.Kind, count int) {
+	if count == 0 {
+		panic(errors.New("scalc: operation actions are empty"))
+	} else if !validKinds[result] && result != Any && result != Same {
+		panic(fmt.Errorf("scalc: operation result type %v is not valid", result))
+	}
+}
+
+// mustAction проверяет наличие реализации действия пользовательской операции и допустимость типов его операндов
+func mustAction(exists bool, kinds ...reflect.Kind) {
+	if !exists {
+		panic(errors.New("scalc: operation action is nil"))
+	}
+	for _, kind := range kinds {
+		if !validKinds[kind] {
+			panic(fmt.Errorf("scalc: operation operand type %v is not valid", kind))
+		}
+	}
+}
@@ -1,125 +1,389 @@
 package scalc
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"reflect"
+	"sync"
 )
 
 // Calculators опредделяет экспортируемый из модуля тип калькулятора
 type Calculators struct {
-	operators []operators
+	program []instructions // программа калькулятора
+	loops   int            // допустимое количество повторений цикла
+	limits  *Limits        // ограничения ресурсов выполнения выражения (nil, если ограничения не заданы)
+	source  string         // исходное выражение в каноническом виде
 }
 
 // Exec выполняет вырадение calc с набором параметров data и возвращает едиснвенное значение
 // Если по завершению выполнеия вырадения кол-во значений в стеке не равно 1 - возвразается ошибка
 func (calc *Calculators) Exec(data map[string]interface{}) (result interface{}, err error) {
-	do, err := calc.ExecToSlice(data)
-	if err != nil {
+	return calc.ExecContext(context.Background(), data)
+}
+
+// ExecContext работает аналогично Exec, но прерывает выполнение выражения при отмене или истечении срока контекста ctx
+// Контекст проверяется перед каждой операцией, в том числе внутри ветвлений и циклов
+func (calc *Calculators) ExecContext(ctx context.Context, data map[string]interface{}) (result interface{}, err error) {
+	return calc.single(ctx, calc.acquire(data))
+}
+
+// single выполняет выражение calc исполнителем do и возвращает единственное значение стека
+func (calc *Calculators) single(ctx context.Context, do *does) (result interface{}, err error) {
+	defer do.release()
+	if err = calc.run(ctx, do); err != nil {
 		return
-	} else if len(do) != 1 {
-		err = errors.New("the resulting stack size is not equal to one")
+	} else if len(do.stack) != 1 {
+		temp := failure(ErrResult, errors.New("the resulting stack size is not equal to one"))
+		temp.Stack = append(make([]interface{}, 0, len(do.stack)), do.stack...)
+		err = temp
 	} else {
-		result = do[0]
+		result = do.stack[0]
 	}
 	return
 }
 
 // ExecToSlice выполняет выражение calc с набором параметров data и возвращает все значения,
 // находящиеся в стеке послезавершения выполнения выражения
+// Ошибки выполнения возвращаются в виде *Error
 func (calc *Calculators) ExecToSlice(data map[string]interface{}) (result []interface{}, err error) {
+	return calc.ExecToSliceContext(context.Background(), data)
+}
+
+// ExecToSliceContext работает аналогично ExecToSlice, но прерывает выполнение выражения
+// при отмене или истечении срока контекста ctx
+func (calc *Calculators) ExecToSliceContext(ctx context.Context, data map[string]interface{}) (result []interface{}, err error) {
+	return calc.slice(ctx, calc.acquire(data))
+}
+
+// slice выполняет выражение calc исполнителем do и возвращает все значения стека
+func (calc *Calculators) slice(ctx context.Context, do *does) (result []interface{}, err error) {
+	defer do.release()
+	if err = calc.run(ctx, do); err == nil {
+		result = append(make([]interface{}, 0, len(do.stack)), do.stack...)
+	}
+	return
+}
+
+// ExecNamed выполняет выражение calc с набором параметров data и возвращает значения выходных параметров,
+// сохранённых выражением лексемами =>name. Значения, оставшиеся в стеке, не возвращаются
+// Если выражение не сохранило какой-либо из выходных параметров required - возвращается ошибка
+func (calc *Calculators) ExecNamed(data map[string]interface{}, required ...string) (result map[string]interface{}, err error) {
+	return calc.ExecNamedContext(context.Background(), data, required...)
+}
+
+// ExecNamedContext работает аналогично ExecNamed, но прерывает выполнение выражения
+// при отмене или истечении срока контекста ctx
+func (calc *Calculators) ExecNamedContext(ctx context.Context, data map[string]interface{}, required ...string) (result map[string]interface{}, err error) {
+	do := calc.acquire(data)
+	defer do.release()
+	do.output = map[string]interface{}{}
+	if err = calc.run(ctx, do); err != nil {
+		return
+	}
+	for _, name := range required {
+		if _, exists := do.output[name]; !exists {
+			temp := failure(ErrResult, fmt.Errorf("output %#v is not set", name))
+			temp.Stack = append(make([]interface{}, 0, len(do.stack)), do.stack...)
+			return nil, temp
+		}
+	}
+	return do.output, nil
+}
+
+// run выполняет выражение calc исполнителем do в контексте ctx и преобразует панику выполнения в ошибку
+func (calc *Calculators) run(ctx context.Context, do *does) (err error) {
+	if do.done = ctx.Done(); do.done != nil {
+		do.ctx = ctx
+	}
 	defer func() {
 		if temp := recover(); temp != nil {
-			err = temp.(error)
+			err = do.fail(temp)
+			if do.tracer != nil && do.step != nil {
+				do.trace(do.step, true, err)
+			}
 		}
 	}()
-	do := does{make([]interface{}, 0, 16), data}
-	do.exec(calc.operators)
-	result = do.stack
+	do.exec(calc.program)
 	return
 }
 
 // does определяет исполнителя, вычисляющего выражение
 type does struct {
-	stack []interface{}          // стек интерпретатора выражения
-	args  map[string]interface{} // набор параметров, вереданный в Calculators.Exec / Calculators.ExecToSlice
+	stack   []interface{}          // стек интерпретатора выражения
+	args    map[string]interface{} // набор параметров, вереданный в Calculators.Exec / Calculators.ExecToSlice
+	object  interface{}            // структура или словарь с параметрами, переданные в Calculators.ExecObject
+	step    *instructions          // выполняемая инструкция программы
+	loops   int                    // допустимое количество повторений цикла
+	hidden  int                    // глубина вложенности вызовов библиотечных слов, шаги которых не отслеживаются
+	locals  map[string]interface{} // локальные переменные выражения (создаются при первом сохранении)
+	output  map[string]interface{} // выходные параметры выражения (создаются при первом сохранении)
+	ctx     context.Context        // контекст выполнения выражения (только для отменяемого контекста)
+	done    <-chan struct{}        // канал отмены контекста выполнения (nil, если контекст не может быть отменён)
+	limits  *Limits                // ограничения ресурсов выполнения выражения (nil, если ограничения не заданы)
+	steps   int                    // количество выполненных инструкций (только при наличии ограничений)
+	counts  []int                  // счётчики повторений выполняемых циклов
+	returns []int                  // адреса инструкций вызова выполняемых пользовательских слов
+	tracer  Tracer                 // трассировщик выполнения (nil, если трассировка не требуется)
+}
+
+// pool содержит исполнителей, повторно используемых между вызовами Calculators.Exec
+var pool = sync.Pool{New: func() interface{} { return &does{stack: make([]interface{}, 0, 16)} }}
+
+// pooledStack содержит максимальную ёмкость стека исполнителя, возвращаемого в pool
+const pooledStack = 1024
+
+// acquire получает из pool исполнителя для выражения calc с набором параметров data
+func (calc *Calculators) acquire(data map[string]interface{}) *does {
+	do := pool.Get().(*does)
+	do.args, do.loops, do.limits = data, calc.loops, calc.limits
+	return do
+}
+
+// release очищает исполнителя и возвращает его в pool
+// Стек чрезмерной ёмкости не сохраняется, чтобы не удерживать память
+func (do *does) release() {
+	if cap(do.stack) > pooledStack {
+		return
+	}
+	for key := range do.stack {
+		do.stack[key] = nil
+	}
+	for name := range do.locals {
+		delete(do.locals, name)
+	}
+	*do = does{stack: do.stack[:0], locals: do.locals, counts: do.counts[:0], returns: do.returns[:0]}
+	pool.Put(do)
 }
 
 // operators определяет сигнатуру операций (команд) калькулятора
 type operators func(*does)
 
-// exec выполняет заданную ops последовательность операций (выражение) калькулятора
-func (calc *does) exec(ops []operators) {
-	for _, op := range ops {
-		op(calc)
+// Operation определяет операцию калькулятора: её исполнение и статическую проверку
+// Пользовательские операции создаются функциями Unary, Binary, Ternary и Stack
+type Operation struct {
+	exec    operators            // исполнение операции
+	check   func(*checks) *Error // моделирование операции при статической проверке выражения
+	arity   int                  // количество значений, снимаемых операцией с вершины стека
+	pure    bool                 // результат операции определяется только её операндами (допускает вычисление при разборе)
+	builtin string               // имя встроенной операции, распознаваемой оптимизатором и декомпилятором (dup, drop, swap, over, @)
+}
+
+// Pure возвращает копию операции, помеченную как чистая: результат операции определяется только её операндами,
+// поэтому оптимизатор может вычислить её над константами при разборе выражения
+// Операции, обращающиеся к внешним данным (курсам валют, текущему времени и т.п.), не должны помечаться чистыми
+func (op Operation) Pure() Operation {
+	op.pure = true
+	return op
+}
+
+// need проверяет, что в стеке находится не менее count значений
+func (do *does) need(count int) {
+	if len(do.stack) < count {
+		panic(failure(ErrStackUnderflow, fmt.Errorf("%d values required, %d available", count, len(do.stack))))
+	}
+}
+
+// fail преобразует значение, полученное от recover, в ошибку с положением выполнявшейся лексемы и снимком стека
+func (do *does) fail(temp interface{}) *Error {
+	err := recovered(temp)
+	if do.step != nil {
+		err.at(do.step.positions)
+	}
+	if err.Stack == nil {
+		err.Stack = append([]interface{}{}, do.stack...)
+	}
+	return err
+}
+
+// kindOf возвращает тип значения стека; для допустимых типов значений reflect не используется
+func kindOf(value interface{}) reflect.Kind {
+	switch value.(type) {
+	case int64:
+		return reflect.Int64
+	case float64:
+		return reflect.Float64
+	case string:
+		return reflect.String
+	case bool:
+		return reflect.Bool
+	case nil:
+		return reflect.Invalid
+	}
+	return reflect.TypeOf(value).Kind()
+}
+
+// slots содержит количество ячеек таблицы действий операции на один операнд:
+// по одной на каждый допустимый тип значения и одна (нулевая) для прочих типов
+const slots = 5
+
+// slotOf возвращает ячейку таблицы действий операции для значения стека
+func slotOf(value interface{}) int {
+	switch value.(type) {
+	case int64:
+		return 1
+	case float64:
+		return 2
+	case string:
+		return 3
+	case bool:
+		return 4
 	}
+	return 0
 }
 
-// unaryActions определяет массив унарных действий (по одной функции на каждый опустимый тип значения)
-type unaryActions map[reflect.Kind]func(interface{}) interface{}
+// slotKind возвращает ячейку таблицы действий операции для типа значения
+func slotKind(kind reflect.Kind) int {
+	switch kind {
+	case reflect.Int64:
+		return 1
+	case reflect.Float64:
+		return 2
+	case reflect.String:
+		return 3
+	case reflect.Bool:
+		return 4
+	}
+	return 0
+}
+
+// mismatch возвращает ошибку недопустимых типов операндов
+func mismatch(kinds ...reflect.Kind) *Error {
+	return failure(ErrTypeMismatch, fmt.Errorf("operand types %v are not valid", kinds))
+}
+
+// UnaryActions определяет массив унарных действий (по одной функции на каждый допустимый тип значения)
+type UnaryActions map[reflect.Kind]func(interface{}) interface{}
 
 // operatorUnary является фабрикой унарных операций:
-// получает на вход массив унарных действий и возвращает замыкание - операцию
-func operatorUnary(action unaryActions) operators {
-	return func(do *does) {
-		last := len(do.stack) - 1
-		do.stack[last] = action[reflect.TypeOf(do.stack[last]).Kind()](do.stack[last])
+// получает на вход тип результата и массив унарных действий и возвращает операцию
+func operatorUnary(result reflect.Kind, action UnaryActions) Operation {
+	signatures := make([][]reflect.Kind, 0, len(action))
+	table := [slots]func(interface{}) interface{}{}
+	for kind, fn := range action {
+		signatures = append(signatures, []reflect.Kind{kind})
+		if slot := slotKind(kind); slot > 0 {
+			table[slot] = fn
+		}
+	}
+	return Operation{
+		exec: func(do *does) {
+			do.need(1)
+			last := len(do.stack) - 1
+			fn := table[slotOf(do.stack[last])]
+			if fn == nil {
+				panic(mismatch(kindOf(do.stack[last])))
+			}
+			do.stack[last] = fn(do.stack[last])
+		},
+		check: func(chk *checks) *Error { return chk.operands(1, result, signatures) },
+		arity: 1,
+		pure:  true,
 	}
 }
 
-// two определяет ключ бинарного действия: комбинацю типов двух значений
-type two [2]reflect.Kind
+// Two определяет ключ бинарного действия: комбинацию типов двух значений
+type Two [2]reflect.Kind
 
-// unaryActions определяет массив бинарных действий (по одной функции на каждую опустимую комбинацию типов двух значения)
-type binaryActions map[two]func(interface{}, interface{}) interface{}
+// BinaryActions определяет массив бинарных действий (по одной функции на каждую допустимую комбинацию типов двух значений)
+type BinaryActions map[Two]func(interface{}, interface{}) interface{}
 
 // operatorUnary является фабрикой бинарных операций:
-// получает на вход массив бинарных действий и возвращает замыкание - операцию
-func operatorBinary(action binaryActions) operators {
-	return func(do *does) {
-		last := len(do.stack) - 1
-		do.stack[last-1] = action[two{
-			reflect.TypeOf(do.stack[last-1]).Kind(),
-			reflect.TypeOf(do.stack[last]).Kind(),
-		}](do.stack[last-1], do.stack[last])
-		do.stack = do.stack[:last]
+// получает на вход тип результата и массив бинарных действий и возвращает операцию
+func operatorBinary(result reflect.Kind, action BinaryActions) Operation {
+	signatures := make([][]reflect.Kind, 0, len(action))
+	table := [slots][slots]func(interface{}, interface{}) interface{}{}
+	for kinds, fn := range action {
+		signatures = append(signatures, []reflect.Kind{kinds[0], kinds[1]})
+		if one, two := slotKind(kinds[0]), slotKind(kinds[1]); one > 0 && two > 0 {
+			table[one][two] = fn
+		}
+	}
+	return Operation{
+		exec: func(do *does) {
+			do.need(2)
+			last := len(do.stack) - 1
+			fn := table[slotOf(do.stack[last-1])][slotOf(do.stack[last])]
+			if fn == nil {
+				panic(mismatch(kindOf(do.stack[last-1]), kindOf(do.stack[last])))
+			}
+			do.stack[last-1] = fn(do.stack[last-1], do.stack[last])
+			do.stack = do.stack[:last]
+		},
+		check: func(chk *checks) *Error { return chk.operands(2, result, signatures) },
+		arity: 2,
+		pure:  true,
 	}
 }
 
-// two определяет ключ бинарного действия: комбинацю типов двух значений
-type three [3]reflect.Kind
+// Three определяет ключ тернарного действия: комбинацию типов трёх значений
+type Three [3]reflect.Kind
 
-// unaryActions определяет массив бинарных действий (по одной функции на каждую опустимую комбинацию типов двух значения)
-type ternaryActions map[three]func(interface{}, interface{}, interface{}) interface{}
+// TernaryActions определяет массив тернарных действий (по одной функции на каждую допустимую комбинацию типов трёх значений)
+type TernaryActions map[Three]func(interface{}, interface{}, interface{}) interface{}
 
 // operatorUnary является фабрикой тернарных операций:
-// получает на вход массив тернарных действий и возвращает замыкание - операцию
-func operatorTernary(action ternaryActions) operators {
-	return func(do *does) {
-		last := len(do.stack) - 2
-		do.stack[last-1] = action[three{
-			reflect.TypeOf(do.stack[last-1]).Kind(),
-			reflect.TypeOf(do.stack[last]).Kind(),
-			reflect.TypeOf(do.stack[last+1]).Kind(),
-		}](do.stack[last-1], do.stack[last], do.stack[last+1])
-		do.stack = do.stack[:last]
-	}
-}
-
-// operatorUnary является фабрикой операции, помещающей в стек значение константы:
-// получает на вход значение константы и возвращает замыкание - операцию
-func operatorConstant(value interface{}) operators {
-	return func(do *does) {
-		do.stack = append(do.stack, value)
-	}
-}
-
-// operatorSelect явзяется фабрикой операции ветвления (switch)
-// полдучает на вход набор вариантов и возвращает замцкание - операцию
-func operatorSelect(expressions [][]operators) operators {
-	return func(do *does) {
-		last := len(do.stack) - 1
-		code := do.stack[last].(int64)
-		do.stack = do.stack[:last]
-		do.exec(expressions[code])
+// получает на вход тип результата и массив тернарных действий и возвращает операцию
+func operatorTernary(result reflect.Kind, action TernaryActions) Operation {
+	signatures := make([][]reflect.Kind, 0, len(action))
+	table := [slots][slots][slots]func(interface{}, interface{}, interface{}) interface{}{}
+	for kinds, fn := range action {
+		signatures = append(signatures, []reflect.Kind{kinds[0], kinds[1], kinds[2]})
+		if one, two, three := slotKind(kinds[0]), slotKind(kinds[1]), slotKind(kinds[2]); one > 0 && two > 0 && three > 0 {
+			table[one][two][three] = fn
+		}
+	}
+	return Operation{
+		exec: func(do *does) {
+			do.need(3)
+			last := len(do.stack) - 2
+			fn := table[slotOf(do.stack[last-1])][slotOf(do.stack[last])][slotOf(do.stack[last+1])]
+			if fn == nil {
+				panic(mismatch(kindOf(do.stack[last-1]), kindOf(do.stack[last]), kindOf(do.stack[last+1])))
+			}
+			do.stack[last-1] = fn(do.stack[last-1], do.stack[last], do.stack[last+1])
+			do.stack = do.stack[:last]
+		},
+		check: func(chk *checks) *Error { return chk.operands(3, result, signatures) },
+		arity: 3,
+		pure:  true,
+	}
+}
+
+// operatorWord является фабрикой библиотечной операции, вызывающей пользовательское слово
+// Библиотечное слово выполняется как отдельная программа со своим набором локальных переменных
+func operatorWord(word *words) Operation {
+	return Operation{
+		exec: func(do *does) {
+			locals := do.locals
+			do.hidden++
+			do.locals = nil
+			do.exec(word.program)
+			do.locals = locals
+			do.hidden--
+		},
+		check: func(chk *checks) *Error {
+			if err := chk.run(word.body); err != nil {
+				err.Lexeme, err.Offset, err.Operator = -1, -1, ""
+				return err
+			}
+			return nil
+		},
+	}
+}
+
+// truthy проверяет истинность значения: истинными являются true, ненулевые числа и непустые строки
+func truthy(value interface{}) bool {
+	switch value := value.(type) {
+	case bool:
+		return value
+	case int64:
+		return value != 0
+	case float64:
+		return value != 0.0
+	case string:
+		return value != ""
+	default:
+		return false
 	}
 }
@@ -1,8 +1,17 @@
 package scalc
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type rounds struct {
@@ -127,26 +136,1285 @@ func TestSwitch(t *testing.T) {
 	}
 }
 
+func TestConditional(t *testing.T) {
+	for _, err := range test([]rounds{
+		{"? [ ]", nil, true},
+		{"true ? [ 1 ; 2 ] false ? [ 1 ; 2 ]", []interface{}{int64(1), int64(2)}, false},
+		{"5 ? [ a ; b ] 0 ? [ a ; b ] 0.5 ? [ a ; b ] 0.0 ? [ a ; b ] x ? [ a ; b ] ' ? [ a ; b ]",
+			[]interface{}{"a", "b", "a", "b", "a", "b"}, false},
+		{"7 true ? [ 1 + ] 7 false ? [ 1 + ]", []interface{}{int64(8), int64(7)}, false},
+		{"amount @ limit @ > ? [ big ; small ]", []interface{}{"big"}, false},
+		{"true ? [ false ? [ 1 ; 2 ] ; 3 ]", []interface{}{int64(2)}, false},
+		{"0 [ a ; b else c ] 1 [ a ; b else c ] 2 [ a ; b else c ] -1 [ a ; b else c ]",
+			[]interface{}{"a", "b", "c", "c"}, false},
+		{"5 [ else c ] 5 [ a else ]", []interface{}{"c"}, false},
+		{"true [ a else c ] false [ a else c ]", []interface{}{"c", "a"}, false},
+	}, map[string]interface{}{"amount": 150, "limit": 100}) {
+		t.Error(err)
+	}
+	for _, test := range []string{
+		"?",
+		"1 ? 2 [ ]",
+		"1 ? [ 1 ; 2 ; 3 ]",
+		"1 ? [ 1 else 2 ]",
+		"1 [ 1 else 2 ; 3 ]",
+		"1 [ 1 else 2 else 3 ]",
+		"else",
+	} {
+		if _, err := New(test); err == nil {
+			t.Errorf("string %#v is parsed", test)
+		}
+	}
+	for _, test := range []rounds{
+		{"1 ? [ a ; b ] upper", nil, false},
+		{"1 ? [ 1 ; 2 3 ]", nil, true},
+		{"5 1 ? [ 1 + ]", nil, false},
+		{"5 1 ? [ 1 ]", nil, true},
+		{"? [ ]", nil, true},
+		{"1 [ a ; b else c ] upper", nil, false},
+		{"1 [ a ; b else ]", nil, true},
+	} {
+		if _, err := NewChecked(test.expr); (err != nil) != test.isError {
+			t.Errorf("string %#v check => %#v", test.expr, err)
+		}
+	}
+}
+
+func TestLoops(t *testing.T) {
+	for _, err := range test([]rounds{
+		{"1000.0 3 times [ 1.1 * ] round", []interface{}{float64(1331)}, false},
+		{"0 times [ 1 ] 7", []interface{}{int64(7)}, false},
+		{"x 5 times [ '- + ]", []interface{}{"x-----"}, false},
+		{"1 10 times [ 2 * ]", []interface{}{int64(1024)}, false},
+		{"1 while [ dup 100 < ; 3 * ]", []interface{}{int64(243)}, false},
+		{"abc while [ dup len 6 < ; \\s swap + ]", []interface{}{"   abc"}, false},
+		{"500 while [ false ; 1 + ]", []interface{}{int64(500)}, false},
+		{"2 times [ 3 times [ a ] ]", []interface{}{"a", "a", "a", "a", "a", "a"}, false},
+		{"-1 times [ 1 ]", nil, true},
+		{"1.5 times [ 1 ]", nil, true},
+		{"10001 times [ ]", nil, true},
+		{"while [ true ; ]", nil, true},
+	}, nil) {
+		t.Error(err)
+	}
+	for _, test := range []string{
+		"times",
+		"1 times 2 [ ]",
+		"1 times [ 1 ; 2 ]",
+		"1 times [ 1 else 2 ]",
+		"while [ true ]",
+		"while [ true ; 1 ; 2 ]",
+	} {
+		if _, err := New(test); err == nil {
+			t.Errorf("string %#v is parsed", test)
+		}
+	}
+	for _, test := range []rounds{
+		{"1 5 times [ 2 * ] 1 +", nil, false},
+		{"1 5 times [ 2.0 * ]", nil, true},
+		{"1 5 times [ float ] 1 +", nil, false},
+		{"1 5 times [ dup ]", nil, true},
+		{"5 a times [ ]", nil, true},
+		{"1 while [ dup 10 < ; 2 * ] 1 +", nil, false},
+		{"1 while [ 10 < ; 2 * ]", nil, true},
+		{"1 while [ dup 10 < ; drop ]", nil, true},
+	} {
+		if _, err := NewChecked(test.expr); (err != nil) != test.isError {
+			t.Errorf("string %#v check => %#v", test.expr, err)
+		}
+	}
+
+	env := NewEnvironment()
+	if env.SetLoopLimit(0) == nil {
+		t.Error("loop limit 0 is set")
+	}
+	if err := env.SetLoopLimit(3); err != nil {
+		t.Error(err)
+	}
+	for _, test := range []rounds{
+		{"3 times [ ]", nil, false},
+		{"4 times [ ]", nil, true},
+		{"0 while [ dup 3 < ; 1 + ]", nil, false},
+		{"0 while [ dup 4 < ; 1 + ]", nil, true},
+		{"0 while [ true ; ]", nil, true},
+	} {
+		if calc, err := env.New(test.expr); err != nil {
+			t.Errorf("string %#v parse => %#v", test.expr, err)
+		} else if _, err := calc.ExecToSlice(nil); (err != nil) != test.isError {
+			t.Errorf("string %#v calculate => %#v", test.expr, err)
+		} else if err != nil && err.(*Error).Category != ErrLoopLimit {
+			t.Errorf("string %#v calculate => %v", test.expr, err)
+		}
+	}
+}
+
+func TestWords(t *testing.T) {
+	data := map[string]interface{}{"fee": 1234, "tax": 56}
+	for _, err := range test([]rounds{
+		{": pct @ float 100.0 / round ; fee pct tax pct +", []interface{}{float64(13)}, false},
+		{": sq dup * ; : cube dup sq * ; 3 cube", []interface{}{int64(27)}, false},
+		{": inc 1 + ; 0 3 times [ inc ]", []interface{}{int64(3)}, false},
+		{": neg 0 swap - ; 5 true ? [ neg ]", []interface{}{int64(-5)}, false},
+		{": nothing ; 1 nothing", []interface{}{int64(1)}, false},
+		{": inv 1 swap / ; 0 inv", nil, true},
+	}, data) {
+		t.Error(err)
+	}
+	for _, test := range []string{
+		":",
+		": sq dup *",
+		": sq sq ;",
+		": dup 1 ;",
+		": 1 2 ;",
+		": [ 1 ;",
+		"1 [ : sq dup * ; ]",
+		": a : b ; ;",
+		": sq dup * ; : sq 1 ;",
+		": sq ] ;",
+		": sq else ;",
+	} {
+		if _, err := New(test); err == nil {
+			t.Errorf("string %#v is parsed", test)
+		} else if err.(*Error).Category != ErrSyntax {
+			t.Errorf("string %#v parse => %v", test, err)
+		}
+	}
+	for _, test := range []rounds{
+		{": sq dup * ; 2 sq 1 +", nil, false},
+		{": sq dup * ; sq", nil, true},
+		{": sq dup * ; a sq", nil, true},
+	} {
+		if _, err := NewChecked(test.expr); (err != nil) != test.isError {
+			t.Errorf("string %#v check => %#v", test.expr, err)
+		}
+	}
+
+	env := NewEnvironment()
+	if err := env.Define("pct", "@ float 100.0 / round"); err != nil {
+		t.Error(err)
+	}
+	if err := env.Define("inv", "1 swap /"); err != nil {
+		t.Error(err)
+	}
+	for _, test := range []struct{ name, body string }{
+		{"pct", "1"},
+		{"dup", "1"},
+		{"two words", "1"},
+		{"bad", "1 ]"},
+	} {
+		if env.Define(test.name, test.body) == nil {
+			t.Errorf("word %#v is defined", test.name)
+		}
+	}
+	if calc, err := env.NewChecked("fee pct tax pct +"); err != nil {
+		t.Error(err)
+	} else if res, err := calc.Exec(data); err != nil || res != float64(13) {
+		t.Errorf("library word calculate result %#v, %v", res, err)
+	}
+	if _, err := env.NewChecked("a inv"); err == nil {
+		t.Error("library word is not checked")
+	} else if err := err.(*Error); err.Lexeme != 1 || err.Operator != "inv" {
+		t.Errorf("library word check error position %v", err)
+	}
+	if calc, err := env.New("0 inv"); err != nil {
+		t.Error(err)
+	} else if _, err := calc.Exec(nil); err == nil {
+		t.Error("library word division by zero is not error")
+	} else if err := err.(*Error); err.Category != ErrDivisionByZero || err.Lexeme != 1 || err.Operator != "inv" {
+		t.Errorf("library word calculate error position %v", err)
+	}
+	if _, err := New("1 pct"); err != nil {
+		t.Errorf("default environment is changed: %v", err)
+	}
+}
+
+func TestLocals(t *testing.T) {
+	data := map[string]interface{}{"price": 200, "qty": 3}
+	for _, err := range test([]rounds{
+		{"price @ qty @ * !sum $sum $sum 10 / -", []interface{}{int64(540)}, false},
+		{"5 ->x $x $x *", []interface{}{int64(25)}, false},
+		{"1 !x 2 !x $x", []interface{}{int64(2)}, false},
+		{"1 !n 4 times [ $n 2 * !n ] $n", []interface{}{int64(16)}, false},
+		{": twice $x 2 * ; 21 !x twice", []interface{}{int64(42)}, false},
+		{"price @ !price price @ $price =", []interface{}{true}, false},
+		{"'! '$x '!x ${1} !=", []interface{}{"!", "$x", "!x", "${1}", "!="}, false},
+		{"false ? [ 1 !x ] $x", nil, true},
+		{"!x", nil, true},
+	}, data) {
+		t.Error(err)
+	}
+	if len(data) != 2 || data["price"] != 200 {
+		t.Errorf("data is changed: %#v", data)
+	}
+	for _, test := range []string{
+		"$x",
+		"1 !y $x",
+	} {
+		if _, err := New(test); err == nil {
+			t.Errorf("string %#v is parsed", test)
+		}
+	}
+	if _, err := NewChecked("1 !x $x $x + !y"); err != nil {
+		t.Error(err)
+	}
+	if _, err := NewChecked("!x $x"); err == nil {
+		t.Error("store on empty stack is not checked")
+	}
+	if err := Register("!x", actions["dup"]); err == nil {
+		t.Error("local name is registered as operation")
+	}
+
+	env := NewEnvironment()
+	if err := env.Define("sq", "!x $x $x *"); err != nil {
+		t.Error(err)
+	}
+	if env.Define("bad", "$x") == nil {
+		t.Error("word with unset local is defined")
+	}
+	if calc, err := env.New("1 !x 3 sq $x +"); err != nil {
+		t.Error(err)
+	} else if res, err := calc.Exec(nil); err != nil || res != int64(10) {
+		t.Errorf("library word locals result %#v, %v", res, err)
+	}
+}
+
+func TestExecNamed(t *testing.T) {
+	calc, err := New("price @ !p $p =>price $p 10 > ? [ $p 10 / =>discount 'bulk =>reason ] $p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := calc.ExecNamed(map[string]interface{}{"price": 50}, "price", "discount"); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(res, map[string]interface{}{"price": int64(50), "discount": int64(5), "reason": "bulk"}) {
+		t.Errorf("outputs %#v", res)
+	}
+	if res, err := calc.ExecNamed(map[string]interface{}{"price": 5}); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(res, map[string]interface{}{"price": int64(5)}) {
+		t.Errorf("outputs %#v", res)
+	}
+	if _, err := calc.ExecNamed(map[string]interface{}{"price": 5}, "price", "discount"); err == nil {
+		t.Error("required output is not checked")
+	} else if err := err.(*Error); err.Category != ErrResult || len(err.Stack) != 1 {
+		t.Errorf("required output error %#v", err)
+	}
+	if _, err := calc.ExecNamed(map[string]interface{}{"price": "abc"}); err == nil {
+		t.Error("calculate error is not returned")
+	}
+	if res, err := calc.Exec(map[string]interface{}{"price": 7}); err != nil || res != int64(7) {
+		t.Errorf("calculate result %#v, %v", res, err)
+	}
+	if res, err := New("1 =>a 2 =>a"); err != nil {
+		t.Error(err)
+	} else if res, err := res.ExecNamed(nil, "a"); err != nil || res["a"] != int64(2) {
+		t.Errorf("outputs %#v, %v", res, err)
+	}
+	if _, err := NewChecked("=>a"); err == nil {
+		t.Error("output on empty stack is not checked")
+	}
+}
+
+type cents int64
+
+type levels int
+
+func (level levels) String() string {
+	return [...]string{"low", "high"}[level]
+}
+
+type codes struct {
+	prefix string
+	number int
+}
+
+func (code *codes) MarshalText() ([]byte, error) {
+	if code.number < 0 {
+		return nil, errors.New("negative code")
+	}
+	return []byte(fmt.Sprintf("%s-%d", code.prefix, code.number)), nil
+}
+
+func TestArguments(t *testing.T) {
+	calc, err := New("x @")
+	if err != nil {
+		t.Fatal(err)
+	}
+	number, price := 5, cents(250)
+	pnumber := &number
+	moment := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, test := range []struct {
+		value  interface{}
+		result interface{}
+	}{
+		{int8(-3), int64(-3)},
+		{uint32(7), int64(7)},
+		{uint64(math.MaxInt64), int64(math.MaxInt64)},
+		{uintptr(1), int64(1)},
+		{float32(0.5), 0.5},
+		{true, true},
+		{price, int64(250)},
+		{&price, int64(250)},
+		{&pnumber, int64(5)},
+		{json.Number("12"), int64(12)},
+		{json.Number("1.5e1"), 15.0},
+		{moment, moment.Unix()},
+		{&moment, moment.Unix()},
+		{90 * time.Second, 90.0},
+		{1500 * time.Millisecond, 1.5},
+		{levels(1), int64(1)},
+		{struct{ fmt.Stringer }{levels(1)}, "high"},
+		{codes{"A", 12}, "A-12"},
+		{&codes{"B", 3}, "B-3"},
+	} {
+		if res, err := calc.Exec(map[string]interface{}{"x": test.value}); err != nil || res != test.result {
+			t.Errorf("argument %#v => %#v != %#v (%v)", test.value, res, test.result, err)
+		}
+	}
+	for _, test := range []struct {
+		value interface{}
+		err   string
+	}{
+		{nil, `argument "x" is nil`},
+		{(*int)(nil), `argument "x" is nil`},
+		{uint64(math.MaxInt64 + 1), `argument "x" value 9223372036854775808 overflows int64`},
+		{json.Number("1x"), `argument "x" number "1x" is not valid`},
+		{codes{"C", -1}, `argument "x": negative code`},
+		{[]int{1}, `argument "x" type []int is not valid`},
+	} {
+		if _, err := calc.Exec(map[string]interface{}{"x": test.value}); err == nil {
+			t.Errorf("argument %#v is not checked", test.value)
+		} else if err, ok := err.(*Error); !ok || err.Category != ErrParameter || err.Err.Error() != test.err {
+			t.Errorf("argument %#v error %v", test.value, err)
+		}
+	}
+}
+
+type customers struct {
+	Name  string
+	Tier  string `scalc:"tier" json:"level"`
+	Score int    `json:"score,omitempty"`
+	Debt  int    `json:"-"`
+	note  string
+}
+
+type Audits struct {
+	Created time.Time
+	Name    string `json:"auditor"`
+}
+
+type sources struct {
+	Channel string `json:"channel"`
+	Region  string
+}
+
+type flags struct {
+	Urgent bool
+}
+
+type orders struct {
+	*Audits
+	sources
+	*flags
+	ID       uint32
+	Name     string
+	Customer *customers `json:"customer"`
+	Lines    map[string]float64
+	Tags     map[string]interface{}
+}
+
+func TestExecObject(t *testing.T) {
+	moment := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	order := &orders{
+		Audits:   &Audits{moment, "auditor"},
+		sources:  sources{Channel: "web", Region: "eu"},
+		flags:    &flags{Urgent: true},
+		ID:       7,
+		Name:     "order",
+		Customer: &customers{Name: "Ann", Tier: "gold", Score: 3, Debt: 10, note: "vip"},
+		Lines:    map[string]float64{"a": 1.5, "b.c": 2},
+		Tags:     map[string]interface{}{"region": map[string]interface{}{"code": 77}},
+	}
+	for expr, result := range map[string]interface{}{
+		"customer.tier @":         "gold",
+		"customer.Name @":         "Ann",
+		"customer.score @ ID @ +": int64(10),
+		"Name @":                  "order",
+		"auditor @":               "auditor",
+		"Created @":               moment.Unix(),
+		"Lines.a @ Lines.b.c @ +": 3.5,
+		"Tags.region.code @":      int64(77),
+		"channel @ Region @ +":    "webeu",
+		"Urgent @":                true,
+	} {
+		calc, err := New(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res, err := calc.ExecObject(order); err != nil || res != result {
+			t.Errorf("string %#v => %#v != %#v (%v)", expr, res, result, err)
+		}
+		if res, err := calc.ExecObject(*order); err != nil || res != result {
+			t.Errorf("string %#v by value => %#v != %#v (%v)", expr, res, result, err)
+		}
+	}
+	for _, expr := range []string{"customer.Tier @", "customer.level @", "customer.Debt @", "customer.note @",
+		"Customer @", "Lines.d @", "ID.x @", "Audits.Name @", "sources.Region @", "Channel @"} {
+		if calc, err := New(expr); err != nil {
+			t.Error(err)
+		} else if _, err := calc.ExecObject(order); err == nil {
+			t.Errorf("string %#v is executed without error", expr)
+		}
+	}
+	if calc, err := New("auditor @"); err != nil {
+		t.Error(err)
+	} else if _, err := calc.ExecObject(&orders{}); err == nil {
+		t.Error("nil embedded structure is not checked")
+	}
+
+	data := map[string]interface{}{"order": order, "order.ID": 8, "x": map[string]interface{}{"y": "z"}}
+	calc, err := New("order.ID @ order.customer.tier @ x.y @")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, exec := range []func() ([]interface{}, error){
+		func() ([]interface{}, error) { return calc.ExecToSlice(data) },
+		func() ([]interface{}, error) { return calc.ExecObjectToSlice(data) },
+	} {
+		if res, err := exec(); err != nil || !reflect.DeepEqual(res, []interface{}{int64(8), "gold", "z"}) {
+			t.Errorf("nested map result %#v (%v)", res, err)
+		}
+	}
+	if calc, err := NewInfix("customer.score * 2 + Tags.region.code"); err != nil {
+		t.Error(err)
+	} else if res, err := calc.ExecObject(order); err != nil || res != int64(83) {
+		t.Errorf("infix result %#v (%v)", res, err)
+	}
+}
+
+func TestOptionalParameters(t *testing.T) {
+	var empty *string
+	coupon := "SALE"
+	data := map[string]interface{}{"price": 100, "coupon": &coupon, "note": nil, "memo": empty,
+		"order": map[string]interface{}{"discount": 5}}
+	for expr, result := range map[string][]interface{}{
+		"price ?@ coupon ?@ note ?@ memo ?@ missing ?@":  {true, true, false, false, false},
+		"order.discount ?@ order.tax ?@":                 {true, false},
+		"coupon 'none @? note 'none @? missing 0 @?":     {"SALE", "none", int64(0)},
+		"price @ order.discount 0 @? - order.tax 0 @? +": {int64(95)},
+		"coupon ?@ ? [ 10 ; 0 ]":                         {int64(10)},
+	} {
+		calc, err := NewChecked(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res, err := calc.ExecToSlice(data); err != nil || !reflect.DeepEqual(res, result) {
+			t.Errorf("string %#v => %#v != %#v (%v)", expr, res, result, err)
+		}
+	}
+	if _, err := NewChecked("coupon ?@ 1 +"); err == nil {
+		t.Error("existence check result type is not checked")
+	}
+	for expr, category := range map[string]Categories{
+		"missing @":      ErrNotFound,
+		"order.tax @":    ErrNotFound,
+		"note @":         ErrParameter,
+		"1 ?@":           ErrTypeMismatch,
+		"1 2 @?":         ErrTypeMismatch,
+		"price []int @?": ErrParameter,
+	} {
+		calc, err := New(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = calc.Exec(map[string]interface{}{"price": []int{1}, "note": nil, "order": map[string]interface{}{}})
+		if err, ok := err.(*Error); !ok || err.Category != category {
+			t.Errorf("string %#v error %v", expr, err)
+		} else if category == ErrNotFound && !strings.Contains(err.Error(), strings.Fields(expr)[0]) {
+			t.Errorf("string %#v error %v does not name the parameter", expr, err)
+		}
+	}
+}
+
+type recorders struct {
+	steps []string
+}
+
+func (rec *recorders) Before(step Step) {
+	rec.steps = append(rec.steps, fmt.Sprintf("> %s %d %v", step.Operator, step.Lexeme, step.Stack))
+}
+
+func (rec *recorders) After(step Step, err error) {
+	rec.steps = append(rec.steps, fmt.Sprintf("< %s %d %v %v", step.Operator, step.Lexeme, step.Stack, err != nil))
+}
+
+func TestExecTrace(t *testing.T) {
+	env := NewEnvironment()
+	env.SetOptimization(false)
+	if err := env.Define("inc", "1 +"); err != nil {
+		t.Fatal(err)
+	}
+	calc, err := env.New("x @ true ? [ inc ] 0 /")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &recorders{}
+	if _, err := calc.ExecTrace(context.Background(), map[string]interface{}{"x": 1}, rec); err == nil {
+		t.Fatal("division by zero is not error")
+	}
+	if !reflect.DeepEqual(rec.steps, []string{
+		"> x 0 []", "< x 0 [x] false",
+		"> @ 1 [x]", "< @ 1 [1] false",
+		"> true 2 [1]", "< true 2 [1 true] false",
+		"> ? 3 [1 true]", "< ? 3 [1] false",
+		"> inc 5 [1]", "< inc 5 [2] false",
+		"> 0 7 [2]", "< 0 7 [2 0] false",
+		"> / 8 [2 0]", "< / 8 [2 0] true",
+	}) {
+		t.Errorf("trace steps %#v", rec.steps)
+	}
+
+	buffer := &strings.Builder{}
+	if res, err := calc.ExecTrace(context.Background(), map[string]interface{}{"x": 1}, NewTracer(buffer)); err == nil {
+		t.Errorf("trace result %v", res)
+	}
+	if lines := strings.Split(buffer.String(), "\n"); len(lines) != 8 || lines[1] != "1:2\t@\toperation\t[\"x\"] -> [1]" ||
+		!strings.HasPrefix(lines[6], "8:21\t/\toperation\t[2 0] -> error: division by zero") {
+		t.Errorf("trace log %#v", lines)
+	}
+}
+
+func TestDebugger(t *testing.T) {
+	env := NewEnvironment()
+	env.SetOptimization(false)
+	calc, err := env.New(": inc 1 + ; x @ [ 10 ; 20 inc ] 2 times [ inc ] 3 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbg := calc.Debug(context.Background(), map[string]interface{}{"x": 1})
+	defer dbg.Close()
+	position := func() string {
+		step, _ := dbg.Position()
+		return fmt.Sprintf("%d %s %v", step.Lexeme, step.Operator, step.Stack)
+	}
+	for _, round := range []struct {
+		action func() error
+		res    string
+	}{
+		{func() error { return nil }, "5 x []"},
+		{dbg.Step, "6 @ [x]"},
+		{dbg.Step, "7 [ [1]"},
+		{dbg.Step, "10 20 []"},
+		{dbg.Step, "11 inc [20]"},
+		{dbg.Step, "2 1 [20]"},
+		{dbg.StepOver, "3 + [20 1]"},
+		{dbg.Step, "13 2 [21]"},
+		{func() error { dbg.BreakOn("+"); return dbg.Continue() }, "3 + [21 1]"},
+		{func() error { return dbg.SetStack([]interface{}{int64(100), int64(1)}) }, "3 + [100 1]"},
+		{func() error { dbg.ClearBreaks(); dbg.BreakAt(19); return dbg.Continue() }, "19 * [102 3]"},
+	} {
+		if err := round.action(); err != nil || position() != round.res {
+			t.Errorf("debugger position %s != %s (%v)", position(), round.res, err)
+		}
+	}
+	if _, err := dbg.Result(); err == nil {
+		t.Error("result of unfinished execution is not error")
+	}
+	if err := dbg.Continue(); err != nil || !dbg.Done() {
+		t.Errorf("debugger continue %v", err)
+	} else if res, err := dbg.Result(); err != nil || !reflect.DeepEqual(res, []interface{}{int64(306)}) {
+		t.Errorf("debugger result %v (%v)", res, err)
+	} else if err := dbg.Step(); err == nil {
+		t.Error("step of finished execution is not error")
+	}
+
+	dbg = calc.Debug(context.Background(), map[string]interface{}{"x": 1})
+	defer dbg.Close()
+	if err := dbg.SetArg("x", int64(0)); err != nil {
+		t.Fatal(err)
+	}
+	if dbg.Step(); dbg.StepOver() != nil || position() != "7 [ [0]" {
+		t.Errorf("debugger position %s after step over", position())
+	} else if dbg.StepOver(); position() != "13 2 [10]" {
+		t.Errorf("debugger position %s after switch step over", position())
+	} else if dbg.StepOver(); position() != "14 times [10 2]" {
+		t.Errorf("debugger position %s", position())
+	} else if dbg.StepOver(); position() != "18 3 [12]" {
+		t.Errorf("debugger position %s after loop step over", position())
+	}
+	if err := dbg.SetStack([]interface{}{1}); err == nil {
+		t.Error("stack value of type int is set")
+	}
+	if err := dbg.SetStack([]interface{}{"a"}); err != nil {
+		t.Fatal(err)
+	} else if err := dbg.Continue(); err == nil || !dbg.Done() {
+		t.Error("debugger type mismatch is not error")
+	} else if err := err.(*Error); err.Category != ErrTypeMismatch || err.Lexeme != 19 {
+		t.Errorf("debugger error %v", err)
+	} else if _, err := dbg.Result(); err == nil {
+		t.Error("result of failed execution is not error")
+	}
+	if calc.Debug(context.Background(), map[string]interface{}{"x": 1}).Args()["x"] != 1 {
+		t.Error("debugger args are not copied")
+	}
+
+	plain := NewEnvironment()
+	plain.SetOptimization(false)
+	for env, folded := range map[*Environment]bool{defaultEnvironment: true, plain: false} {
+		calc, err := env.New("1 2 + x @ *")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbg := calc.Debug(context.Background(), map[string]interface{}{"x": 2})
+		if dbg.BreakAt(0) == folded || !dbg.BreakAt(2) {
+			t.Errorf("breakpoints on folded lexemes are not reported (optimization %v)", folded)
+		} else if !folded && (dbg.Continue() != nil || dbg.Done()) {
+			t.Error("debugger does not stop at plain lexeme")
+		} else if step, _ := dbg.Position(); !folded && step.Operator != "+" {
+			t.Errorf("debugger position %v on plain lexeme", step)
+		}
+		dbg.Close()
+	}
+}
+
+// cause возвращает исходную ошибку, обёрнутую ошибкой калькулятора (errors.Is недоступна в Go 1.12)
+func cause(err error) error {
+	if err, ok := err.(*Error); ok {
+		return err.Unwrap()
+	}
+	return err
+}
+
+func TestExecContext(t *testing.T) {
+	calc, err := New("1 2 +")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if res, err := calc.ExecContext(ctx, nil); err != nil || res != int64(3) {
+		t.Errorf("calculate result %#v, %v", res, err)
+	}
+	cancel()
+	if _, err := calc.ExecContext(ctx, nil); cause(err) != context.Canceled {
+		t.Errorf("canceled context error %#v", err)
+	} else if err := err.(*Error); err.Category != ErrCanceled || err.Lexeme != 2 {
+		t.Errorf("canceled context error %v", err)
+	}
+	if _, err := calc.ExecToSliceContext(ctx, nil); cause(err) != context.Canceled {
+		t.Errorf("canceled context error %#v", err)
+	}
+	if _, err := calc.ExecNamedContext(ctx, nil); cause(err) != context.Canceled {
+		t.Errorf("canceled context error %#v", err)
+	}
+
+	env := NewEnvironment()
+	if err := env.SetLoopLimit(1 << 40); err != nil {
+		t.Fatal(err)
+	}
+	if calc, err = env.New("0 while [ true ; 1 [ 0 ; 1 + ] ]"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := calc.ExecContext(ctx, nil); cause(err) != context.DeadlineExceeded {
+		t.Errorf("deadline error %#v", err)
+	} else if err := err.(*Error); err.Category != ErrCanceled || err.Lexeme < 0 {
+		t.Errorf("deadline error %v", err)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	env := NewEnvironment()
+	if env.SetLimits(Limits{MaxSteps: -1}) == nil {
+		t.Error("negative limit is set")
+	}
+	if err := env.SetLimits(Limits{MaxSteps: 100, MaxStackDepth: 10, MaxStringLength: 64, MaxRegexSize: 8}); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []rounds{
+		{"1 10 times [ 2 * ]", []interface{}{int64(1024)}, false},
+		{"0 while [ true ; 1 + ]", nil, true},
+		{"1 10 times [ dup ]", nil, true},
+		{"a 7 times [ dup + ]", nil, true},
+		{"a 6 times [ dup + ] len", []interface{}{int64(64)}, false},
+		{"10d 5 format len", []interface{}{int64(10)}, false},
+		{"100d 5 format", nil, true},
+		{".99f 5.0 format", nil, true},
+		{"'%100d 5 format", []interface{}{"%100d%!(EXTRA int64=5)"}, false},
+		{"'*d 1000 format", nil, true},
+		{"a(b)c abc regexMatch", []interface{}{true}, false},
+		{"a(b)c(d)e abc regexMatch", nil, true},
+		{"a(b)c(d)e x abc regexReplace", nil, true},
+		{"x* " + strings.Repeat("b", 64) + " " + strings.Repeat("a", 64) + " regexReplace", nil, true},
+		{"a b aaaa regexReplace", []interface{}{"bbbb"}, false},
+		{"(a) $1$1 aaaa regexReplace", []interface{}{"aaaaaaaa"}, false},
+		{"a aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa aaaa replace", nil, true},
+		{"a bb aaaa replace", []interface{}{"bbbbbbbb"}, false},
+	} {
+		calc, err := env.New(test.expr)
+		if err != nil {
+			t.Errorf("string %#v parse => %#v", test.expr, err)
+			continue
+		}
+		res, err := calc.ExecToSlice(nil)
+		if test.isError {
+			if err == nil {
+				t.Errorf("string %#v calculate %#v is not error", test.expr, res)
+			} else if err.(*Error).Category != ErrLimit {
+				t.Errorf("string %#v calculate => %v", test.expr, err)
+			}
+		} else if err != nil || !reflect.DeepEqual(res, test.res) {
+			t.Errorf("string %#v calculate result %#v != %#v (%v)", test.expr, res, test.res, err)
+		}
+	}
+	long := Stack(nil, []reflect.Kind{reflect.String, reflect.String}, func(stack []interface{}) ([]interface{}, error) {
+		return append(stack, strings.Repeat("a", 100), "b"), nil
+	})
+	if err := env.Register("long", long); err != nil {
+		t.Fatal(err)
+	} else if calc, err := env.New("long"); err != nil {
+		t.Error(err)
+	} else if _, err := calc.ExecToSlice(nil); err == nil || err.(*Error).Category != ErrLimit {
+		t.Errorf("string below the top of the stack is not checked: %v", err)
+	}
+	if err := env.SetLimits(Limits{MaxStringLength: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	if calc, err := env.New("x* y @ s @ regexReplace"); err != nil {
+		t.Error(err)
+	} else {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := calc.Exec(map[string]interface{}{"y": strings.Repeat("b", 1000), "s": strings.Repeat("a", 1000)})
+		runtime.ReadMemStats(&after)
+		if err == nil || err.(*Error).Category != ErrLimit {
+			t.Errorf("replacement result length is not checked: %v", err)
+		} else if size := after.TotalAlloc - before.TotalAlloc; size > 100000 && !raceEnabled {
+			t.Errorf("replacement result length is checked after allocation of %d bytes", size)
+		}
+	}
+	for _, limits := range []Limits{{MaxStringLength: 50}, {}} {
+		if err := env.SetLimits(limits); err != nil {
+			t.Fatal(err)
+		}
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		calc, err := env.New("a" + strings.Repeat(" dup +", 27))
+		runtime.ReadMemStats(&after)
+		if err != nil {
+			t.Error(err)
+		} else if size := after.TotalAlloc - before.TotalAlloc; size > 100000 && !raceEnabled {
+			t.Errorf("limits %v: constant folding allocates %d bytes", limits, size)
+		} else if limits.MaxStringLength == 0 {
+			continue
+		} else if _, err := calc.Exec(nil); err == nil || err.(*Error).Category != ErrLimit {
+			t.Errorf("folded string length is not checked: %v", err)
+		}
+	}
+	if err := env.SetLimits(Limits{}); err != nil {
+		t.Fatal(err)
+	}
+	if calc, err := env.New("1 10 times [ dup ]"); err != nil {
+		t.Error(err)
+	} else if _, err := calc.ExecToSlice(nil); err != nil {
+		t.Errorf("limits are not removed: %v", err)
+	}
+}
+
+func TestCompile(t *testing.T) {
+	plain := NewEnvironment()
+	plain.SetOptimization(false)
+	calc, err := plain.New("x @ [ a ; b ; c else d ] 3 times [ 1 ] true ? [ 2 ; 3 ] while [ false ; ]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes := make([]opcodes, len(calc.program))
+	for key, in := range calc.program {
+		codes[key] = in.code
+	}
+	if !reflect.DeepEqual(codes, []opcodes{
+		opConstant, opOperation, opSwitch, opConstant, opJump, opConstant, opJump, opConstant, opJump, opConstant,
+		opConstant, opTimes, opConstant, opNext,
+		opConstant, opJumpFalse, opConstant, opJump, opConstant,
+		opEnter, opConstant, opWhile, opJump, opReturn,
+	}) {
+		t.Errorf("program codes %v", codes)
+	}
+	if table := calc.program[2].table; !reflect.DeepEqual(table, []int{0, 2, 4, 6, 7}) || !calc.program[2].fallback {
+		t.Errorf("switch table %v", table)
+	}
+	for code, res := range map[int64]string{0: "a", 2: "c", 3: "d", -1: "d"} {
+		if res1, err := calc.ExecToSlice(map[string]interface{}{"x": code}); err != nil || res1[0] != res {
+			t.Errorf("switch %d result %#v, %v", code, res1, err)
+		}
+	}
+
+	env := NewEnvironment()
+	if err := env.Define("inc", ": two 1 + 1 + ; two 1 -"); err != nil {
+		t.Fatal(err)
+	}
+	if calc, err = env.New(": twice inc inc ; : four twice twice ; 0 four 10 times [ twice ]"); err != nil {
+		t.Fatal(err)
+	} else if res, err := calc.Exec(nil); err != nil || res != int64(24) {
+		t.Errorf("words result %#v, %v", res, err)
+	}
+	if calc, err = New(": inv 1 swap / ; 1 inv 0 inv"); err != nil {
+		t.Fatal(err)
+	} else if _, err := calc.Exec(nil); err == nil {
+		t.Error("division by zero in word is not error")
+	} else if err := err.(*Error); err.Lexeme != 4 || err.Operator != "/" {
+		t.Errorf("word error position %v", err)
+	}
+}
+
+func TestOptimize(t *testing.T) {
+	plain := NewEnvironment()
+	plain.SetOptimization(false)
+	optimized := NewEnvironment()
+	lookup := Unary(reflect.Float64, UnaryActions{reflect.String: func(val interface{}) interface{} { return 1.5 }})
+	for _, env := range []*Environment{plain, optimized} {
+		if err := env.Register("rate", lookup); err != nil {
+			t.Fatal(err)
+		}
+		if err := env.Register("pureRate", lookup.Pure()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, test := range []struct {
+		expr string
+		size int
+	}{
+		{"2 3 + 10 *", 1},
+		{"'%.2f 1.5 format", 3},
+		{"1 2 swap over", 3},
+		{"x @ dup drop", 2},
+		{"x @ y @ swap swap -", 5},
+		{"x @ 1 2 + swap dup drop swap -", 4},
+		{"1 swap swap", 3},
+		{"1 2 swap swap", 2},
+		{"2 [ a ; b ; c ] len", 1},
+		{"7 [ a ; b else c ]", 1},
+		{"1 2 < ? [ x @ ; y @ ] 1 +", 4},
+		{"false ? [ 1 ]", 0},
+		{"3 times [ 1 2 + ]", 4},
+		{"EUR rate", 2},
+		{"EUR pureRate", 1},
+		{": pct 100.0 / ; 50 pct 1 2 +", 6},
+	} {
+		calc, err := optimized.New(test.expr)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(calc.program)-1 != test.size {
+			t.Errorf("string %#v program size %d != %d", test.expr, len(calc.program)-1, test.size)
+		}
+	}
+	for _, test := range []string{
+		"1 0 /",
+		"2 [ a ; b ]",
+		"abc int",
+		"abc 1 + dup drop",
+		"x @ y @ swap swap -",
+		"dup drop",
+		"swap swap",
+		"1 swap swap",
+		"1 dup drop 2 swap swap",
+		"EUR rate 2.0 *",
+		"EUR pureRate 2.0 *",
+		"'%.2f 1.5 format",
+		": pct 100.0 / ; 50 pct 1 2 +",
+	} {
+		data := map[string]interface{}{"x": 10, "y": 3}
+		var results [2]interface{}
+		var errs [2]error
+		for key, env := range []*Environment{plain, optimized} {
+			if calc, err := env.New(test); err != nil {
+				t.Fatal(err)
+			} else {
+				results[key], errs[key] = calc.ExecToSlice(data)
+			}
+		}
+		if !reflect.DeepEqual(results[0], results[1]) || fmt.Sprint(errs[0]) != fmt.Sprint(errs[1]) {
+			t.Errorf("string %#v optimized result %#v, %v != %#v, %v", test, results[1], errs[1], results[0], errs[0])
+		}
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	data := map[string]interface{}{"x": 2, "s": "abc"}
+	for _, expr := range []string{
+		"",
+		"  1   2 +\t3 *  ",
+		"x @ [ 1.5 ; 'a\\sb ; true else -7 ] s @ upper",
+		": sq dup * ; x @ sq !y $y 3 times [ $y + ] =>out s @ len 3 > ? [ yes ; no ]",
+		"0 while [ dup 5 < ; 1 + ] x @ 1 = s @ 'b regexMatch or",
+	} {
+		calc, err := New(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := calc.ExecToSlice(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bin, err := calc.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded := &Calculators{}
+		if err := loaded.UnmarshalBinary(bin); err != nil {
+			t.Errorf("string %#v load => %v", expr, err)
+		} else if res, err := loaded.ExecToSlice(data); err != nil || !reflect.DeepEqual(res, expected) {
+			t.Errorf("string %#v loaded result %#v != %#v (%v)", expr, res, expected, err)
+		}
+		text, err := calc.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := loaded.UnmarshalText(text); err != nil {
+			t.Errorf("string %#v text %#v parse => %v", expr, text, err)
+		} else if res, err := loaded.ExecToSlice(data); err != nil || !reflect.DeepEqual(res, expected) {
+			t.Errorf("string %#v text result %#v != %#v (%v)", expr, res, expected, err)
+		} else if again, _ := loaded.MarshalText(); string(again) != string(text) {
+			t.Errorf("string %#v text %#v != %#v", expr, again, text)
+		}
+		for length := range bin {
+			if _, err := NewEnvironment().Load(bin[:length]); err == nil {
+				t.Errorf("string %#v truncated binary %d is loaded", expr, length)
+			}
+		}
+	}
+	if calc, err := New("  1   2 +\t3 *  "); err != nil {
+		t.Fatal(err)
+	} else if text, _ := calc.MarshalText(); string(text) != "1 2 + 3 *" {
+		t.Errorf("canonical text %#v", string(text))
+	}
+
+	calc, err := New("s @ upper x @ [ a ; b ]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin, err := calc.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := NewEnvironment()
+	if err := env.Remove("upper"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.Load(bin); err == nil {
+		t.Error("binary with unavailable operation is loaded")
+	} else if err := err.(*Error); err.Category != ErrSyntax || err.Operator != "upper" {
+		t.Errorf("unavailable operation error %v", err)
+	}
+	bin[len(binaryMagic)] = binaryVersion + 1
+	if _, err := NewEnvironment().Load(bin); err == nil {
+		t.Error("binary with unknown version is loaded")
+	}
+	bin[len(binaryMagic)] = binaryVersion
+	calc.program[5].table[1] = 100
+	if bin, err = calc.MarshalBinary(); err != nil {
+		t.Fatal(err)
+	} else if _, err := NewEnvironment().Load(bin); err == nil {
+		t.Error("binary with invalid jump is loaded")
+	}
+}
+
+func TestFormatExpression(t *testing.T) {
+	for expr, res := range map[string]string{
+		"":                           "",
+		"  1   2 +\t3 *  ":           "1 2 + 3 *",
+		"'abc abc":                   "abc abc",
+		"1e3 1.0 1.5 '1 '1.5":        "1000.0 1.0 1.5 '1 '1.5",
+		"'true 'dup 'else '[ 'a\\sb": "'true 'dup 'else '[ 'a\\sb",
+		"'$x 'a\\\\ ''":              "'$x 'a\\\\ ''",
+		"5 ->x $x =>y !z":            "5 !x $x =>y !z",
+		": sq dup * ; 'sq sq":        ": sq dup * ; 'sq sq",
+		"x @ [ a ;  b else  c ] true ? [ 1 ; 2 ] 3 times [ 1 ] while [ false ; ]": "x @ [ a ; b else c ] true ? [ 1 ; 2 ] 3 times [ 1 ] while [ false ; ]",
+	} {
+		if text, err := Format(expr); err != nil || text != res {
+			t.Errorf("string %#v format %#v != %#v (%v)", expr, text, res, err)
+		} else if again, err := Format(text); err != nil || again != text {
+			t.Errorf("string %#v format is not stable: %#v (%v)", expr, again, err)
+		}
+	}
+	if _, err := Format("1 ]"); err == nil {
+		t.Error("format of invalid expression is not error")
+	}
+	if calc, err := New("1 ->x  'abc $x"); err != nil {
+		t.Fatal(err)
+	} else if text, _ := calc.MarshalText(); string(text) != "1 !x abc $x" {
+		t.Errorf("canonical text %#v", string(text))
+	}
+}
+
+func TestFormatValues(t *testing.T) {
+	values := []interface{}{int64(-1), 2.0, 1e21, true, "a b\\c", "", "1", "dup", "'x"}
+	if text := FormatValues(values); text != `-1 2.0 1e+21 true "a b\\c" "" "1" "dup" "'x"` {
+		t.Errorf("values %#v", text)
+	}
+	text := FormatConstants(values)
+	if calc, err := New(text); err != nil {
+		t.Errorf("constants %#v => %v", text, err)
+	} else if res, err := calc.ExecToSlice(nil); err != nil || !reflect.DeepEqual(res, values) {
+		t.Errorf("constants %#v result %#v (%v)", text, res, err)
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	plain := NewEnvironment()
+	plain.SetOptimization(false)
+	calc, err := plain.New(": sq dup * ; x @ [ 'a ; 1.5 else true ] 2 times [ sq ]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ` 0  constant  string "x"	; 5:13 x
+ 1  operation @	; 6:15 @
+ 2  switch    -> [ 3 ; 5 ; else 7 ] end 8	; 7:17 [
+ 3    constant  string "a"	; 8:19 'a
+ 4    jump      -> 8	; 7:17 [
+ 5    constant  float64 1.5	; 10:24 1.5
+ 6    jump      -> 8	; 7:17 [
+ 7    constant  bool true	; 12:33 true
+ 8  constant  int64 2	; 14:40 2
+ 9  times     -> 12	; 15:42 times
+10    call      sq -> 13	; 17:50 sq
+11  next      -> 10	; 15:42 times
+12  return
+sq:
+13  operation dup	; 2:5 dup
+14  operation *	; 3:9 *
+15  return
+`
+	if text := calc.Disassemble(); text != strings.Replace(expected, "\\t", "\t", -1) || calc.String() != text {
+		t.Errorf("disassembly\n%s", text)
+	}
+}
+
+func TestInfix(t *testing.T) {
+	data := map[string]interface{}{"price": 10, "qty": 3, "discount": 5, "s": "abcab", "order.tier": "gold"}
+	for expr, postfix := range map[string]string{
+		"(price * qty) - discount":                         "price @ qty @ * discount @ -",
+		"price * qty - discount":                           "price @ qty @ * discount @ -",
+		"price * (qty - discount)":                         "price @ qty @ discount @ - *",
+		"-qty ** 2 + 2 ** 3 ** 2":                          "qty @ 2 ** -- 2 3 2 ** ** +",
+		"10 - 4 - 3 == 3 and not false":                    "10 4 - 3 - 3 = false not and",
+		"max(price, qty * 4) % 7 != 5":                     "price @ qty @ 4 * max 7 % 5 #",
+		"replace(s, \"ab\", \"x y\") + upper(s)":           "'ab 'x\\sy s @ replace s @ upper +",
+		"regexReplace(s, \"b+\", \"-\")":                   "'b+ '- s @ regexReplace",
+		"if(price > 5 or qty < 1, 1.5, 2.5)":               "price @ 5 > qty @ 1 < or ? [ 1.5 ; 2.5 ]",
+		"len(order.tier) <= 4 xor true":                    "order.tier @ len 4 <= true xor",
+		"~1 << 2 | 1 & 3 ^ 8 >> 1":                         "1 ~ 2 << 1 3 & | 8 1 >> ^",
+		"-9223372036854775808 == -9223372036854775807 - 1": "-9223372036854775808 -9223372036854775807 1 - =",
+		"-2.0 ** 2.0 + -(1.5)":                             "2.0 2.0 ** -- -1.5 +",
+		"\"@\" + \"1\" + \"\"":                             "'@ '1 + ' +",
+	} {
+		calc, err := NewInfix(expr)
+		if err != nil {
+			t.Errorf("infix %#v => %v", expr, err)
+			continue
+		}
+		expected, err := New(postfix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		text, _ := calc.MarshalText()
+		if source, _ := expected.MarshalText(); string(text) != string(source) {
+			t.Errorf("infix %#v => %#v != %#v", expr, string(text), string(source))
+		}
+		res, err := calc.ExecToSlice(data)
+		if res1, err1 := expected.ExecToSlice(data); !reflect.DeepEqual(res, res1) || (err == nil) != (err1 == nil) {
+			t.Errorf("infix %#v result %v != %v (%v, %v)", expr, res, res1, err, err1)
+		}
+	}
+
+	for expr, res := range map[string]struct {
+		lexeme int
+		offset int
+	}{
+		"":              {0, 0},
+		"1 +":           {2, 3},
+		"(1 + 2":        {4, 6},
+		"1 2":           {1, 2},
+		"max(1)":        {0, 0},
+		"unknown(1, 2)": {0, 0},
+		"1 $ 2":         {1, 2},
+		"\"abc":         {0, 0},
+		"if(1, 2)":      {0, 0},
+		"f(1,)":         {4, 4},
+		"and":           {0, 0},
+	} {
+		if _, err := NewInfix(expr); err == nil {
+			t.Errorf("infix %#v is not error", expr)
+		} else if err := err.(*Error); err.Category != ErrSyntax || err.Lexeme != res.lexeme || err.Offset != res.offset {
+			t.Errorf("infix %#v error %v", expr, err)
+		}
+	}
+	if calc, err := NewInfix("format(\".2f\", 1.5) + left(s, 3)"); err != nil {
+		t.Fatal(err)
+	} else if res, err := calc.Exec(data); err != nil || res != "1.50abc" {
+		t.Errorf("infix format result %#v (%v)", res, err)
+	}
+	if calc, err := NewInfix("replace(s, \"ab\", \"x\")"); err != nil {
+		t.Fatal(err)
+	} else if res, err := calc.Exec(data); err != nil || res != "xcx" {
+		t.Errorf("infix replace result %#v (%v)", res, err)
+	}
+	if calc, err := NewInfix("price / (qty - 3)"); err != nil {
+		t.Fatal(err)
+	} else if _, err := calc.Exec(data); err == nil {
+		t.Error("infix division by zero is not error")
+	} else if err := err.(*Error); err.Category != ErrDivisionByZero || err.Lexeme != 1 || err.Offset != 6 || err.Operator != "/" {
+		t.Errorf("infix division error %v", err)
+	}
+}
+
+func TestDecompile(t *testing.T) {
+	data := map[string]interface{}{"price": 10, "qty": 3, "discount": 5, "x": 2, "f": 1.5, "b": true, "s": "abc"}
+	for expr, res := range map[string]struct {
+		infix    string
+		parsable bool
+	}{
+		"price @ qty @ * discount @ -":          {"price * qty - discount", true},
+		"price @ qty @ discount @ - *":          {"price * (qty - discount)", true},
+		"2.0 3.0 2.0 ** ** 2.0 3.0 ** 2.0 ** +": {"2.0 ** 3.0 ** 2.0 + (2.0 ** 3.0) ** 2.0", true},
+		"f @ 2.0 ** -- f @ -- 2.0 ** -":         {"-f ** 2.0 - (-f) ** 2.0", true},
+		"x @ 1 - 2 - x @ 1 2 - - =":             {"x - 1 - 2 == x - (1 - 2)", true},
+		"b @ not true and 1 2 # or":             {"not b and true or 1 != 2", true},
+		"s @ 'a 'b\\sc replace qty @ -3 max":    {"replace(\"b c\", s, \"a\"), max(qty, -3)", false},
+		"x @ 0 > ? [ 1 ; 2.5 ]":                 {"if(x > 0, 1, 2.5)", true},
+		"5 x @ 0 > ? [ 1 + ]":                   {"if(x > 0, 5 + 1, 5)", true},
+		"price @ qty @ swap -":                  {"qty - price", true},
+		"x @ dup *":                             {"x * x", true},
+		"'a 'b s @ replace":                     {"replace(s, \"a\", \"b\")", true},
+		"x @ ! x @ 1 - ! and":                   {"!x and !(x - 1)", true},
+		": sq dup * ; qty @ 1 + sq":             {"let $1 = qty + 1; $1 * $1", false},
+		"price @ qty @ + x @ over * +":          {"let $1 = price + qty; $1 + x * $1", false},
+		"1 x @ [ 1 + ; 2 * else 3 - ]":          {"case x when 0 then 1 + 1 when 1 then 1 * 2 else 1 - 3 end", false},
+		"1 10 times [ 2 * ]":                    {"let $1 = 1; repeat 10 { $1 = $1 * 2 }; $1", false},
+		"1 while [ dup 100 < ; 3 * ]":           {"let $1 = 1; while $1 < 100 { $1 = $1 * 3 }; $1", false},
+		"5 !x $x $x * =>y":                      {"let $x = 5; =>y = $x * $x", false},
+		"'a\\sb @ 1 2":                          {"@(\"a b\"), 1, 2", false},
+	} {
+		text, err := Decompile(expr)
+		if err != nil || text != res.infix {
+			t.Errorf("string %#v decompiled %#v != %#v (%v)", expr, text, res.infix, err)
+			continue
+		} else if !res.parsable {
+			continue
+		}
+		calc, err := NewInfix(text)
+		if err != nil {
+			t.Errorf("string %#v decompiled %#v => %v", expr, text, err)
+			continue
+		}
+		expected, _ := New(expr)
+		res1, err1 := calc.ExecToSlice(data)
+		if res2, err2 := expected.ExecToSlice(data); err1 != nil || err2 != nil || !reflect.DeepEqual(res1, res2) {
+			t.Errorf("string %#v decompiled result %v != %v (%v, %v)", expr, res1, res2, err1, err2)
+		}
+	}
+	for _, expr := range []string{"1 +", "x @ [ 1 ; 1 2 ]", "1 ]"} {
+		if _, err := Decompile(expr); err == nil {
+			t.Errorf("string %#v decompiled without error", expr)
+		}
+	}
+	if calc, err := NewInfix("(price - discount) * max(qty, 2)"); err != nil {
+		t.Fatal(err)
+	} else if text, err := calc.Decompile(); err != nil || text != "(price - discount) * max(qty, 2)" {
+		t.Errorf("calculator decompiled %#v (%v)", text, err)
+	}
+}
+
+func TestNewChecked(t *testing.T) {
+	for _, test := range []rounds{
+		{"", nil, false},
+		{"1 2 + 3.5 float swap drop", nil, false},
+		{"a 1 2 swap over drop drop drop len 1 +", nil, false},
+		{"data @ 1 +", nil, false},
+		{"data @ a +", nil, false},
+		{"data @ [ 1 ; 2 ]", nil, false},
+		{"0 [ 1 ; 2.5 ] dup +", nil, false},
+		{"0 [ 1 [ a ; b ] ; c ] upper", nil, false},
+		{"1 +", nil, true},
+		{"drop", nil, true},
+		{"abc 1 -", nil, true},
+		{"1.5 2.5 %", nil, true},
+		{"a b c replace 1 replace", nil, true},
+		{"1 2 swap over drop drop drop drop", nil, true},
+		{"data @ a -", nil, true},
+		{"a [ 1 ; 2 ]", nil, true},
+		{"0 [ 1 ; 2 3 ]", nil, true},
+		{"0 [ 1 ; 1 [ 2 ; 3 drop ] ]", nil, true},
+		{"0 [ a ; b ] 1 [ 2 ; 3 ] +", nil, true},
+	} {
+		if _, err := NewChecked(test.expr); (err != nil) != test.isError {
+			t.Errorf("string %#v check => %#v", test.expr, err)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	for _, test := range []struct {
+		expr     string
+		checked  bool
+		category Categories
+		lexeme   int
+		offset   int
+		operator string
+		stack    int
+	}{
+		{"1 ]", false, ErrSyntax, 1, 2, "]", 0},
+		{"0 [ 1 ;", false, ErrSyntax, 1, 2, "[", 0},
+		{" ; 1", false, ErrSyntax, 0, 1, ";", 0},
+		{"1  +", true, ErrStackUnderflow, 1, 3, "+", 0},
+		{"abc 1 -", true, ErrTypeMismatch, 2, 6, "-", 0},
+		{"0 [ 1 ; 2 3 ]", true, ErrStackEffect, 1, 2, "[", 0},
+		{"a 1 +", false, ErrTypeMismatch, 2, 4, "+", 2},
+		{"1 0 [ drop drop ]", false, ErrStackUnderflow, 4, 11, "drop", 0},
+		{"7 0 /", false, ErrDivisionByZero, 2, 4, "/", 2},
+		{"7 0 %", false, ErrDivisionByZero, 2, 4, "%", 2},
+		{"abc int", false, ErrConversion, 1, 4, "int", 1},
+		{"abc 5 left", false, ErrOperand, 2, 6, "left", 2},
+		{"3 [ 1 ; 2 ]", false, ErrOperand, 1, 2, "[", 1},
+		{"x @", false, ErrNotFound, 1, 2, "@", 1},
+		{"1 2", false, ErrResult, -1, -1, "", 2},
+	} {
+		var err error
+		if test.checked {
+			_, err = NewChecked(test.expr)
+		} else if calc, temp := New(test.expr); temp != nil {
+			err = temp
+		} else {
+			_, err = calc.Exec(nil)
+		}
+		if temp, ok := err.(*Error); !ok {
+			t.Errorf("string %#v => %#v is not *Error", test.expr, err)
+		} else if temp.Category != test.category || temp.Lexeme != test.lexeme || temp.Offset != test.offset ||
+			temp.Operator != test.operator || len(temp.Stack) != test.stack {
+			t.Errorf("string %#v => %v %#v", test.expr, temp, temp.Stack)
+		}
+	}
+}
+
 func TestCompareOperations(t *testing.T) {
 	for _, err := range test([]rounds{
-		{" 1 2 = 2 1 = 2 2 = ", []interface{}{int64(0), int64(0), int64(1)}, false},
-		{" 1 2 # 2 1 # 2 2 # ", []interface{}{int64(1), int64(1), int64(0)}, false},
-		{" 1 2 > 2 1 > 2 2 > ", []interface{}{int64(0), int64(1), int64(0)}, false},
-		{" 1 2 < 2 1 < 2 2 < ", []interface{}{int64(1), int64(0), int64(0)}, false},
-		{" 1 2 >= 2 1 >= 2 2 >= ", []interface{}{int64(0), int64(1), int64(1)}, false},
-		{" 1 2 <= 2 1 <= 2 2 <= ", []interface{}{int64(1), int64(0), int64(1)}, false},
-		{" 1.2 2.1 = 2.3 1.4 = 2.5 2.5 = ", []interface{}{int64(0), int64(0), int64(1)}, false},
-		{" 1.2 2.1 # 2.3 1.4 # 2.5 2.5 # ", []interface{}{int64(1), int64(1), int64(0)}, false},
-		{" 1.2 2.1 > 2.3 1.4 > 2.5 2.5 > ", []interface{}{int64(0), int64(1), int64(0)}, false},
-		{" 1.2 2.1 < 2.3 1.4 < 2.5 2.5 < ", []interface{}{int64(1), int64(0), int64(0)}, false},
-		{" 1.2 2.1 >= 2.3 1.4 >= 2.5 2.5 >= ", []interface{}{int64(0), int64(1), int64(1)}, false},
-		{" 1.2 2.1 <= 2.3 1.4 <= 2.5 2.5 <= ", []interface{}{int64(1), int64(0), int64(1)}, false},
-		{" aaa bbb = ddd ccc = eee eee = ", []interface{}{int64(0), int64(0), int64(1)}, false},
-		{" aaa bbb # ddd ccc # eee eee # ", []interface{}{int64(1), int64(1), int64(0)}, false},
-		{" aaa bbb > ddd ccc > eee eee > ", []interface{}{int64(0), int64(1), int64(0)}, false},
-		{" aaa bbb < ddd ccc < eee eee < ", []interface{}{int64(1), int64(0), int64(0)}, false},
-		{" aaa bbb >= ddd ccc >= eee eee >= ", []interface{}{int64(0), int64(1), int64(1)}, false},
-		{" aaa bbb <= ddd ccc <= eee eee <= ", []interface{}{int64(1), int64(0), int64(1)}, false},
+		{" 1 2 = 2 1 = 2 2 = ", []interface{}{false, false, true}, false},
+		{" 1 2 # 2 1 # 2 2 # ", []interface{}{true, true, false}, false},
+		{" 1 2 > 2 1 > 2 2 > ", []interface{}{false, true, false}, false},
+		{" 1 2 < 2 1 < 2 2 < ", []interface{}{true, false, false}, false},
+		{" 1 2 >= 2 1 >= 2 2 >= ", []interface{}{false, true, true}, false},
+		{" 1 2 <= 2 1 <= 2 2 <= ", []interface{}{true, false, true}, false},
+		{" 1.2 2.1 = 2.3 1.4 = 2.5 2.5 = ", []interface{}{false, false, true}, false},
+		{" 1.2 2.1 # 2.3 1.4 # 2.5 2.5 # ", []interface{}{true, true, false}, false},
+		{" 1.2 2.1 > 2.3 1.4 > 2.5 2.5 > ", []interface{}{false, true, false}, false},
+		{" 1.2 2.1 < 2.3 1.4 < 2.5 2.5 < ", []interface{}{true, false, false}, false},
+		{" 1.2 2.1 >= 2.3 1.4 >= 2.5 2.5 >= ", []interface{}{false, true, true}, false},
+		{" 1.2 2.1 <= 2.3 1.4 <= 2.5 2.5 <= ", []interface{}{true, false, true}, false},
+		{" aaa bbb = ddd ccc = eee eee = ", []interface{}{false, false, true}, false},
+		{" aaa bbb # ddd ccc # eee eee # ", []interface{}{true, true, false}, false},
+		{" aaa bbb > ddd ccc > eee eee > ", []interface{}{false, true, false}, false},
+		{" aaa bbb < ddd ccc < eee eee < ", []interface{}{true, false, false}, false},
+		{" aaa bbb >= ddd ccc >= eee eee >= ", []interface{}{false, true, true}, false},
+		{" aaa bbb <= ddd ccc <= eee eee <= ", []interface{}{true, false, true}, false},
 	}, nil) {
 		t.Error(err)
 	}
@@ -164,14 +1432,14 @@ func TestUnaryOperators(t *testing.T) {
 		{"25 -- 0 -- -25 --", []interface{}{int64(-25), int64(0), int64(25)}, false},
 		{"25.25 -- 0.0 -- -25.25 --", []interface{}{float64(-25.25), float64(0.0), float64(25.25)}, false},
 		{"25 ~ 0 ~ -25 ~", []interface{}{int64(^25), int64(^0), int64(^-25)}, false},
-		{"25 ! 0 ! -25 !", []interface{}{int64(0), int64(1), int64(0)}, false},
+		{"25 ! 0 ! -25 !", []interface{}{false, true, false}, false},
 		{"25 abs 0 abs -25 abs", []interface{}{int64(25), int64(0), int64(25)}, false},
 		{"25.25 abs 0.0 abs -25.25 abs", []interface{}{float64(25.25), float64(0.0), float64(25.25)}, false},
 		{"25 sign 0 sign -25 sign", []interface{}{int64(1), int64(0), int64(-1)}, false},
 		{"25.25 sign 0.0 sign -25.25 sign", []interface{}{int64(1), int64(0), int64(-1)}, false},
 		{"2.25 sqrt", []interface{}{float64(1.5)}, false},
-		{"1.0 0.0 / isInf -1.0 0.0 / isInf -1.0 isInf 0.0 isInf 1.0 isInf", []interface{}{int64(1), int64(1), int64(0), int64(0), int64(0)}, false},
-		{"-1.0 sqrt isNaN -1.0 isNaN 0.0 isNaN 1.0 isNaN", []interface{}{int64(1), int64(0), int64(0), int64(0)}, false},
+		{"1.0 0.0 / isInf -1.0 0.0 / isInf -1.0 isInf 0.0 isInf 1.0 isInf", []interface{}{true, true, false, false, false}, false},
+		{"-1.0 sqrt isNaN -1.0 isNaN 0.0 isNaN 1.0 isNaN", []interface{}{true, false, false, false}, false},
 		{"3.0 ln 5.0 ln + exp 0.10f swap format", []interface{}{"15.0000000000"}, false},
 		{"7.49 ceil 7.5 ceil 7.51 ceil -7.49 ceil -7.5 ceil -7.51 ceil",
 			[]interface{}{float64(8.0), float64(8.0), float64(8.0), float64(-7.0), float64(-7.0), float64(-7.0)}, false},
@@ -185,9 +1453,9 @@ func TestUnaryOperators(t *testing.T) {
 		{"' len aaa len", []interface{}{int64(0), int64(3)}, false},
 		{"\\s\\t\\naaa\\s\\t\\n dup trim", []interface{}{" \t\naaa \t\n", "aaa"}, false},
 		{"пРоСтОТеСтрЕгИсТрА upper пРоСтОТеСтрЕгИсТрА lower", []interface{}{"ПРОСТОТЕСТРЕГИСТРА", "простотестрегистра"}, false},
-		{"' isEmpty a isEmpty", []interface{}{int64(1), int64(0)}, false},
-		{"0 isEmpty -1 isEmpty 1 isEmpty", []interface{}{int64(1), int64(0), int64(0)}, false},
-		{"0.0 isEmpty -1.1 isEmpty 1.1 isEmpty", []interface{}{int64(1), int64(0), int64(0)}, false},
+		{"' isEmpty a isEmpty", []interface{}{true, false}, false},
+		{"0 isEmpty -1 isEmpty 1 isEmpty", []interface{}{true, false, false}, false},
+		{"0.0 isEmpty -1.1 isEmpty 1.1 isEmpty", []interface{}{true, false, false}, false},
 	}, nil) {
 		t.Error(err)
 	}
@@ -223,13 +1491,56 @@ func TestBinaryOperators(t *testing.T) {
 		{"abcdefabcdef cd indexLast abcdefabcdef ce indexLast", []interface{}{int64(8), int64(-1)}, false},
 		{"abcdef 2 left", []interface{}{"ab"}, false},
 		{"abcdef 2 right", []interface{}{"ef"}, false},
-		{"c.{3}c abcdabcd regexMatch c.{2}c abcdabcd regexMatch", []interface{}{int64(1), int64(0)}, false},
+		{"c.{3}c abcdabcd regexMatch c.{2}c abcdabcd regexMatch", []interface{}{true, false}, false},
 		{") abcdabcd regexMatch", nil, true},
 	}, nil) {
 		t.Error(err)
 	}
 }
 
+func TestBoolOperators(t *testing.T) {
+	for _, err := range test([]rounds{
+		{"true false 'true", []interface{}{true, false, "true"}, false},
+		{"true true and true false and false false and", []interface{}{true, false, false}, false},
+		{"true true or true false or false false or", []interface{}{true, true, false}, false},
+		{"true true xor true false xor false false xor", []interface{}{false, true, false}, false},
+		{"true not false not true ! false !", []interface{}{false, true, false, true}, false},
+		{"true true = true false = true true # true false #", []interface{}{true, false, false, true}, false},
+		{"1 2 < 3 4 > or 5 5 = and", []interface{}{true}, false},
+		{"true int false int true float true string false string", []interface{}{int64(1), int64(0), float64(1), "true", "false"}, false},
+		{"5 bool 0 bool 0.5 bool 0.0 bool 'true bool 'false bool 'T bool true bool", []interface{}{true, false, true, false, true, false, true, true}, false},
+		{"true isEmpty false isEmpty", []interface{}{false, true}, false},
+		{"t true format 5v false format", []interface{}{"true", "false"}, false},
+		{"1 2 > [ small ; big ] 2 1 > [ small ; big ]", []interface{}{"small", "big"}, false},
+		{"yes bool", nil, true},
+		{"1 true and", nil, true},
+		{"true 1 +", nil, true},
+		{"true false <", nil, true},
+		{"flag @ not", []interface{}{false}, false},
+		{"pflag @", []interface{}{true}, false},
+	}, map[string]interface{}{"flag": true, "pflag": &[]bool{true}[0]}) {
+		t.Error(err)
+	}
+	for _, test := range []rounds{
+		{"1 2 < 3 4 > or", nil, false},
+		{"1 2 < [ a ; b ]", nil, false},
+		{"1 2 < 1 +", nil, true},
+		{"1 2 and", nil, true},
+	} {
+		if _, err := NewChecked(test.expr); (err != nil) != test.isError {
+			t.Errorf("string %#v check => %#v", test.expr, err)
+		}
+	}
+	if calc, err := New("limit @ amount @ <"); err != nil {
+		t.Error(err)
+	} else if res, err := calc.Exec(map[string]interface{}{"limit": 10, "amount": 20}); err != nil || res != true {
+		t.Errorf("result %#v, %#v is not true", res, err)
+	}
+	if Register("true", actions["dup"]) == nil {
+		t.Error("name \"true\" is registered")
+	}
+}
+
 func TestFormatOperator(t *testing.T) {
 	for _, err := range test([]rounds{
 		{"5s abc format", []interface{}{"  abc"}, false},
@@ -275,8 +1586,9 @@ func TestAttributes(t *testing.T) {
 	for _, err := range test([]rounds{
 		{"@", []interface{}{""}, true},
 		{"test @", []interface{}{""}, true},
-		{"u_64 @", nil, true},
-		{"pu_64 @", nil, true},
+		{"u_64 @", []interface{}{int64(20)}, false},
+		{"pu_64 @", []interface{}{int64(20)}, false},
+		{"mu_64 @", nil, true},
 		{"nu_64 @", nil, true},
 		{"i_ @", []interface{}{int64(6)}, false},
 		{"i_8 @", []interface{}{int64(7)}, false},
@@ -301,6 +1613,7 @@ func TestAttributes(t *testing.T) {
 		"i_32":  int32(9),
 		"i_64":  int64(10),
 		"u_64":  uint64(20),
+		"mu_64": uint64(math.MaxUint64),
 		"f_32":  float32(21.5),
 		"f_64":  float64(22.25),
 		"st":    "aaaa",
@@ -318,6 +1631,178 @@ func TestAttributes(t *testing.T) {
 	}
 }
 
+func TestRegister(t *testing.T) {
+	for _, err := range []error{
+		Register("testVat", Unary(reflect.Float64, UnaryActions{
+			reflect.Int64:   func(val interface{}) interface{} { return float64(val.(int64)) * 1.2 },
+			reflect.Float64: func(val interface{}) interface{} { return val.(float64) * 1.2 },
+		})),
+		Register("testRepeat", Binary(reflect.String, BinaryActions{
+			Two{reflect.String, reflect.Int64}: func(v1, v2 interface{}) interface{} {
+				result := ""
+				for i := int64(0); i < v2.(int64); i++ {
+					result += v1.(string)
+				}
+				return result
+			},
+		})),
+		Register("testClamp", Ternary(Same, TernaryActions{
+			Three{reflect.Int64, reflect.Int64, reflect.Int64}: func(v1, v2, v3 interface{}) interface{} {
+				if v1.(int64) < v2.(int64) {
+					return v2
+				} else if v1.(int64) > v3.(int64) {
+					return v3
+				}
+				return v1
+			},
+		})),
+		Register("testRot", Stack([]reflect.Kind{Any, Any, Any}, []reflect.Kind{Any, Any, Any},
+			func(stack []interface{}) ([]interface{}, error) {
+				last := len(stack) - 1
+				stack[last-2], stack[last-1], stack[last] = stack[last-1], stack[last], stack[last-2]
+				return stack, nil
+			})),
+		Register("testSplit", Stack([]reflect.Kind{reflect.String}, []reflect.Kind{reflect.String, reflect.String},
+			func(stack []interface{}) ([]interface{}, error) {
+				last := len(stack) - 1
+				str := stack[last].(string)
+				if len(str) == 0 {
+					return nil, NewError(ErrOperand, errors.New("empty string"))
+				}
+				return append(stack[:last], str[:1], str[1:]), nil
+			})),
+		Register("testBroken", Stack(nil, []reflect.Kind{reflect.Int64},
+			func(stack []interface{}) ([]interface{}, error) {
+				return append(stack, "1"), nil
+			})),
+	} {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	for _, name := range []string{"testVat", "dup", "+", "[", "]", ";", "", "a b", "'a", "1", "-2.5e3"} {
+		if Register(name, actions["drop"]) == nil {
+			t.Errorf("name %#v is registered", name)
+		}
+	}
+	for _, err := range test([]rounds{
+		{"10 testVat 2.5 testVat", []interface{}{float64(12), float64(3)}, false},
+		{"ab 3 testRepeat", []interface{}{"ababab"}, false},
+		{"5 1 3 testClamp -5 1 3 testClamp 2 1 3 testClamp", []interface{}{int64(3), int64(1), int64(2)}, false},
+		{"1 2 3 testRot", []interface{}{int64(2), int64(3), int64(1)}, false},
+		{"abc testSplit", []interface{}{"a", "bc"}, false},
+		{"abc testVat", nil, true},
+		{"1 2 testRot", nil, true},
+		{"1 testSplit", nil, true},
+		{"' testSplit", nil, true},
+		{"testBroken", nil, true},
+	}, nil) {
+		t.Error(err)
+	}
+	for _, test := range []rounds{
+		{"10 testVat 1 +", nil, true},
+		{"1 2 3 testRot + +", nil, false},
+		{"1 testSplit", nil, true},
+		{"abc testSplit +", nil, false},
+	} {
+		if _, err := NewChecked(test.expr); (err != nil) != test.isError {
+			t.Errorf("string %#v check => %#v", test.expr, err)
+		}
+	}
+	calc, _ := New("' testSplit")
+	if _, err := calc.Exec(nil); err == nil || err.(*Error).Category != ErrOperand {
+		t.Errorf("string %#v calculate => %#v", "' testSplit", err)
+	}
+	for _, fn := range []func(){
+		func() { Unary(reflect.Int64, UnaryActions{}) },
+		func() {
+			Unary(reflect.Int, UnaryActions{reflect.Int64: func(val interface{}) interface{} { return val }})
+		},
+		func() { Unary(reflect.Int64, UnaryActions{Any: func(val interface{}) interface{} { return val }}) },
+		func() { Binary(reflect.Int64, BinaryActions{Two{reflect.Int64, reflect.Int64}: nil}) },
+		func() {
+			Stack([]reflect.Kind{reflect.Uint}, nil, func(stack []interface{}) ([]interface{}, error) { return stack, nil })
+		},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("invalid operation is created")
+				}
+			}()
+			fn()
+		}()
+	}
+}
+
+func TestEnvironment(t *testing.T) {
+	pricing := NewEnvironment()
+	reporting := NewEnvironment()
+	if err := pricing.Remove("regexReplace", "timeParse"); err != nil {
+		t.Error(err)
+	}
+	if pricing.Remove("regexMatch", "unknownOperation") == nil {
+		t.Error("unknown operation is removed")
+	}
+	if err := reporting.Register("percent", Unary(reflect.String, UnaryActions{
+		reflect.Float64: func(val interface{}) interface{} { return fmt.Sprintf("%.1f%%", val.(float64)*100) },
+	})); err != nil {
+		t.Error(err)
+	}
+	if err := reporting.Override("upper", Unary(reflect.String, UnaryActions{
+		reflect.String: func(val interface{}) interface{} { return "<" + val.(string) + ">" },
+	})); err != nil {
+		t.Error(err)
+	}
+	if reporting.Override("unknownOperation", actions["drop"]) == nil {
+		t.Error("unknown operation is overridden")
+	}
+	for _, test := range []struct {
+		env  *Environment
+		expr string
+		res  interface{}
+	}{
+		{pricing, "a b abc regexReplace", nil},
+		{pricing, "a 'regexReplace +", "aregexReplace"},
+		{pricing, "a abc regexMatch drop b upper", "B"},
+		{pricing, "0.25 percent", "percent"},
+		{reporting, "0.25 percent", "25.0%"},
+		{reporting, "abc upper", "<abc>"},
+		{reporting, "a b abc regexReplace", "bbc"},
+	} {
+		if calc, err := test.env.New(test.expr); err != nil {
+			if test.res != nil {
+				t.Errorf("string %#v parse => %#v", test.expr, err)
+			}
+		} else if test.res == nil {
+			t.Errorf("string %#v is parsed", test.expr)
+		} else if res, err := calc.ExecToSlice(nil); err != nil || res[len(res)-1] != test.res {
+			t.Errorf("string %#v calculate result %#v != %#v", test.expr, res, test.res)
+		}
+	}
+	if res, err := New("abc upper"); err != nil {
+		t.Error(err)
+	} else if res, _ := res.Exec(nil); res != "ABC" {
+		t.Errorf("default environment is changed: %#v", res)
+	}
+
+	group := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		group.Add(1)
+		go func(i int) {
+			defer group.Done()
+			env := NewEnvironment()
+			name := fmt.Sprintf("word%d", i)
+			if err := env.Register(name, actions["dup"]); err != nil {
+				t.Error(err)
+			} else if _, err := env.NewChecked("1 " + name + " +"); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	group.Wait()
+}
+
 func TestCalculators_Exec(t *testing.T) {
 	for _, test := range []rounds{
 		{"drop", nil, true},
@@ -341,6 +1826,82 @@ func TestCalculators_Exec(t *testing.T) {
 	}
 }
 
+// benchmarks содержит типичные выражения для измерения скорости выполнения
+// и допустимое количество выделений памяти при их выполнении: новые строки, числа с плавающей точкой
+// и целые числа вне диапазона 0..255 размещаются в куче при упаковке в interface{}
+var benchmarks = []struct {
+	name, expr string
+	allocs     float64
+}{
+	{"arithmetic", "1 2 + 3 * 4 - 5 %", 0},
+	{"compare", "10 20 < 3 4 = and not", 0},
+	{"switch", "2 [ 1 ; 2 ; 3 ] 1 +", 0},
+	{"condition", "5 3 > ? [ 1 ; 0 ] 1 swap -", 0},
+	{"stack", "1 2 swap over drop drop dup +", 0},
+	{"strings", "abc def + len 6 =", 2},
+	{"loop", "0 10 times [ 1 + ]", 0},
+	{"locals", "3 !x $x $x * $x +", 0},
+	{"float", "1.5 2.5 * round", 2},
+	{"argument", "data @ 1 +", 0},
+}
+
+func TestAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops pooled executors under the race detector")
+	}
+	data := map[string]interface{}{"data": int64(125)}
+	plain := NewEnvironment()
+	plain.SetOptimization(false)
+	for _, test := range benchmarks {
+		calc, err := plain.New(test.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := calc.Exec(data); err != nil {
+			t.Fatalf("string %#v calculate => %v", test.expr, err)
+		}
+		if allocs := testing.AllocsPerRun(100, func() { calc.Exec(data) }); allocs > test.allocs {
+			t.Errorf("string %#v calculate allocations %v > %v", test.expr, allocs, test.allocs)
+		}
+	}
+}
+
+func BenchmarkExec(b *testing.B) {
+	data := map[string]interface{}{"data": int64(125)}
+	plain := NewEnvironment()
+	plain.SetOptimization(false)
+	for _, env := range []struct {
+		name string
+		env  *Environment
+	}{{"plain", plain}, {"optimized", NewEnvironment()}} {
+		for _, test := range benchmarks {
+			calc, err := env.env.New(test.expr)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Run(env.name+"/"+test.name, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					calc.Exec(data)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkExecParallel(b *testing.B) {
+	calc, err := New(benchmarks[0].expr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			calc.Exec(nil)
+		}
+	})
+}
+
 func test(check []rounds, data map[string]interface{}) (result []string) {
 	result = make([]string, 0)
 	for _, test := range check {
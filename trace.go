@@ -0,0 +1,80 @@
+package scalc
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// Step описывает шаг выполнения выражения, передаваемый трассировщику
+type Step struct {
+	Code     string        // вид инструкции: operation, constant, switch, jump, times и т.д. (см. Calculators.Disassemble)
+	Operator string        // лексема (имя операции), соответствующая инструкции
+	Lexeme   int           // порядковый номер лексемы в выражении (с нуля)
+	Offset   int           // смещение лексемы в выражении в байтах
+	Stack    []interface{} // стек выполнения; действителен только до возврата из метода трассировщика и не должен изменяться
+}
+
+// Tracer определяет трассировщик выполнения выражения
+// Before вызывается перед выполнением каждой инструкции, After - после её выполнения;
+// если выполнение инструкции завершилось ошибкой, After получает эту ошибку
+// Шаги библиотечных слов (см. Environment.Define) не трассируются: слово выполняется как одна операция
+type Tracer interface {
+	Before(step Step)
+	After(step Step, err error)
+}
+
+// ExecTrace работает аналогично ExecToSliceContext, но вызывает трассировщик tracer для каждого шага выполнения
+func (calc *Calculators) ExecTrace(ctx context.Context, data map[string]interface{}, tracer Tracer) (result []interface{}, err error) {
+	do := calc.acquire(data)
+	defer do.release()
+	do.tracer = tracer
+	if err = calc.run(ctx, do); err == nil {
+		result = append(make([]interface{}, 0, len(do.stack)), do.stack...)
+	}
+	return
+}
+
+// trace вызывает трассировщик для инструкции in: до её выполнения, если after - false, и после в противном случае
+func (do *does) trace(in *instructions, after bool, err error) {
+	if in.index < 0 {
+		return
+	}
+	step := Step{in.code.String(), in.lexeme, in.index, in.offset, do.stack}
+	if after {
+		do.tracer.After(step, err)
+	} else {
+		do.tracer.Before(step)
+	}
+}
+
+// writers определяет трассировщик, записывающий шаги выполнения в текстовом виде
+type writers struct {
+	out    io.Writer
+	before string // стек перед выполнением текущей инструкции
+}
+
+// NewTracer создаёт трассировщик, записывающий в out по одной строке на каждый шаг выполнения:
+// положение и лексему инструкции, вид инструкции, стек до и после её выполнения либо ошибку
+func NewTracer(out io.Writer) Tracer {
+	return &writers{out: out}
+}
+
+// Before запоминает состояние стека перед выполнением инструкции
+func (tr *writers) Before(step Step) {
+	tr.before = formatStack(step.Stack)
+}
+
+// After записывает шаг выполнения
+func (tr *writers) After(step Step, err error) {
+	result := formatStack(step.Stack)
+	if err != nil {
+		result = "error: " + err.Error()
+	}
+	fmt.Fprintf(tr.out, "%d:%d\t%s\t%s\t%s -> %s\n", step.Lexeme, step.Offset, step.Operator, step.Code, tr.before, result)
+}
+
+// formatStack возвращает значения стека в скобках, разделённые пробелами (строки - в кавычках)
+func formatStack(stack []interface{}) string {
+	return "[" + FormatValues(stack) + "]"
+}